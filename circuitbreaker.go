@@ -0,0 +1,151 @@
+package weft
+
+import (
+	"bytes"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Circuit breaker states.
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half-open"
+)
+
+// CircuitBreakerOptions configures CircuitBreaker.
+type CircuitBreakerOptions struct {
+	// Threshold is the number of consecutive failed results that opens the circuit.  Defaults to 5.
+	Threshold int
+	// CoolDown is how long the circuit stays open before a probe request is allowed.  Defaults to 10s.
+	CoolDown time.Duration
+	// OnStateChange is called for each state transition e.g., to increment metrics.  Optional.
+	OnStateChange func(from, to string)
+	// IsFailure returns true if res is a failure of the dependency.  Defaults to 5xx results
+	// so that bad requests from one client don't open the circuit for everyone.
+	IsFailure func(res *Result) bool
+}
+
+type circuit struct {
+	sync.Mutex
+	opts     CircuitBreakerOptions
+	state    string
+	failures int
+	opened   time.Time
+	probing  bool
+}
+
+/*
+CircuitBreaker wraps h which calls a dependency that may fail.  After opts.Threshold
+consecutive failed results, 5xx by default, the circuit opens and requests are answered with
+http.StatusServiceUnavailable without calling h.  After opts.CoolDown the circuit is
+half-open and a single request is allowed through to probe the dependency.  A successful
+probe closes the circuit, a failed probe opens it again.  Requests that were allowed through
+before the circuit opened don't change its state when they finish after it opened.
+
+To count all non 2xx results, other than http.StatusNotModified, as failures e.g.,
+
+	opts.IsFailure = func(res *weft.Result) bool {
+		return res.Code/100 != 2 && res.Code != http.StatusNotModified
+	}
+
+A panic in h is a failure.  The panic is not recovered.
+*/
+func CircuitBreaker(opts CircuitBreakerOptions, h RequestHandler) RequestHandler {
+	if opts.Threshold <= 0 {
+		opts.Threshold = 5
+	}
+
+	if opts.CoolDown <= 0 {
+		opts.CoolDown = 10 * time.Second
+	}
+
+	if opts.IsFailure == nil {
+		opts.IsFailure = func(res *Result) bool {
+			return res.Code >= http.StatusInternalServerError
+		}
+	}
+
+	c := &circuit{opts: opts, state: CircuitClosed}
+
+	return func(r *http.Request, header http.Header, b *bytes.Buffer) *Result {
+		probe, allowed := c.allow()
+		if !allowed {
+			return &Result{Ok: false, Code: http.StatusServiceUnavailable, Msg: "circuit open"}
+		}
+
+		var ok bool
+		defer func() { c.done(probe, ok) }()
+
+		res := h(r, header, b)
+		ok = !c.opts.IsFailure(res)
+
+		return res
+	}
+}
+
+// allow returns true for allowed if a request may be passed to the handler and true for
+// probe if the request is the probe for the half-open circuit.
+func (c *circuit) allow() (probe, allowed bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	switch c.state {
+	case CircuitOpen:
+		if time.Since(c.opened) < c.opts.CoolDown {
+			return false, false
+		}
+		c.transition(CircuitHalfOpen)
+		c.probing = true
+		return true, true
+	case CircuitHalfOpen:
+		if c.probing {
+			return false, false
+		}
+		c.probing = true
+		return true, true
+	}
+
+	return false, true
+}
+
+// done records the result of a request passed to the handler.  probe is from allow for
+// the request.  Only the probe changes the state of a half-open circuit.
+func (c *circuit) done(probe, ok bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	switch {
+	case probe:
+		c.probing = false
+		if ok {
+			c.failures = 0
+			c.transition(CircuitClosed)
+		} else {
+			c.opened = time.Now()
+			c.transition(CircuitOpen)
+		}
+	case c.state == CircuitClosed:
+		if ok {
+			c.failures = 0
+			return
+		}
+
+		c.failures++
+		if c.failures >= c.opts.Threshold {
+			c.opened = time.Now()
+			c.transition(CircuitOpen)
+		}
+	}
+}
+
+// transition changes the state of c.  Must be called with c locked.
+func (c *circuit) transition(to string) {
+	from := c.state
+	c.state = to
+
+	if c.opts.OnStateChange != nil {
+		c.opts.OnStateChange(from, to)
+	}
+}
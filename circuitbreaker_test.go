@@ -0,0 +1,216 @@
+package weft
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	r, err := http.NewRequest("GET", "http://test.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var calls int
+	var fail bool
+	var transitions []string
+
+	h := func(r *http.Request, h http.Header, b *bytes.Buffer) *Result {
+		calls++
+		if fail {
+			return ServiceUnavailableError(errors.New("upstream down"))
+		}
+		return &StatusOK
+	}
+
+	opts := CircuitBreakerOptions{
+		Threshold: 2,
+		CoolDown:  20 * time.Millisecond,
+		OnStateChange: func(from, to string) {
+			transitions = append(transitions, from+">"+to)
+		},
+	}
+
+	cb := CircuitBreaker(opts, h)
+
+	var b bytes.Buffer
+
+	call := func(code, expectCalls int) {
+		calls = 0
+		res := cb(r, http.Header{}, &b)
+		if res.Code != code {
+			t.Errorf("%s expected code %d got %d", loc(), code, res.Code)
+		}
+		if calls != expectCalls {
+			t.Errorf("%s expected %d handler calls got %d", loc(), expectCalls, calls)
+		}
+	}
+
+	// closed
+	call(http.StatusOK, 1)
+
+	// client errors and not modified are not failures by default.
+	var code int
+	client := func(r *http.Request, h http.Header, b *bytes.Buffer) *Result {
+		return &Result{Ok: false, Code: code}
+	}
+
+	other := CircuitBreaker(CircuitBreakerOptions{Threshold: 2}, client)
+	for _, code = range []int{http.StatusNotModified, http.StatusBadRequest, http.StatusNotFound, http.StatusMethodNotAllowed} {
+		for i := 0; i < 5; i++ {
+			if res := other(r, http.Header{}, &b); res.Code != code {
+				t.Errorf("expected %d got %d", code, res.Code)
+			}
+		}
+	}
+
+	// IsFailure can count client errors as failures.
+	other = CircuitBreaker(CircuitBreakerOptions{Threshold: 2, IsFailure: func(res *Result) bool {
+		return !success(res.Code) && res.Code != http.StatusNotModified
+	}}, client)
+
+	code = http.StatusBadRequest
+	for i, c := range []int{http.StatusBadRequest, http.StatusBadRequest, http.StatusServiceUnavailable} {
+		if res := other(r, http.Header{}, &b); res.Code != c {
+			t.Errorf("%d expected %d got %d", i, c, res.Code)
+		}
+	}
+
+	// failures below the threshold keep the circuit closed.
+	fail = true
+	call(http.StatusServiceUnavailable, 1)
+	if len(transitions) != 0 {
+		t.Errorf("expected no transitions got %v", transitions)
+	}
+
+	// open
+	call(http.StatusServiceUnavailable, 1)
+	call(http.StatusServiceUnavailable, 0)
+	call(http.StatusServiceUnavailable, 0)
+
+	// half-open probe fails and opens the circuit again.
+	time.Sleep(30 * time.Millisecond)
+	call(http.StatusServiceUnavailable, 1)
+	call(http.StatusServiceUnavailable, 0)
+
+	// half-open probe succeeds and closes the circuit.
+	time.Sleep(30 * time.Millisecond)
+	fail = false
+	call(http.StatusOK, 1)
+	call(http.StatusOK, 1)
+
+	expected := []string{
+		"closed>open",
+		"open>half-open",
+		"half-open>open",
+		"open>half-open",
+		"half-open>closed",
+	}
+
+	if len(transitions) != len(expected) {
+		t.Fatalf("expected transitions %v got %v", expected, transitions)
+	}
+
+	for i := range expected {
+		if transitions[i] != expected[i] {
+			t.Errorf("expected transition %s got %s", expected[i], transitions[i])
+		}
+	}
+}
+
+func TestCircuitBreakerPanic(t *testing.T) {
+	r, err := http.NewRequest("GET", "http://test.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var panics bool
+
+	cb := CircuitBreaker(CircuitBreakerOptions{Threshold: 1, CoolDown: 20 * time.Millisecond},
+		func(r *http.Request, h http.Header, b *bytes.Buffer) *Result {
+			if panics {
+				panic("upstream client bug")
+			}
+			return &StatusOK
+		})
+
+	call := func() (res *Result, p interface{}) {
+		defer func() { p = recover() }()
+		return cb(r, http.Header{}, &bytes.Buffer{}), nil
+	}
+
+	// a panic is a failure and opens the circuit.
+	panics = true
+	if _, p := call(); p == nil {
+		t.Error("expected the panic to be passed on")
+	}
+
+	if res, _ := call(); res == nil || res.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected the circuit to be open got %+v", res)
+	}
+
+	// a panicking probe opens the circuit again and doesn't block later probes.
+	time.Sleep(30 * time.Millisecond)
+	if _, p := call(); p == nil {
+		t.Error("expected the probe to panic")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	panics = false
+	if res, _ := call(); res == nil || res.Code != http.StatusOK {
+		t.Errorf("expected the circuit to close got %+v", res)
+	}
+}
+
+func TestCircuitBreakerProbe(t *testing.T) {
+	var transitions []string
+
+	c := &circuit{state: CircuitClosed, opts: CircuitBreakerOptions{
+		Threshold: 1,
+		CoolDown:  20 * time.Millisecond,
+		OnStateChange: func(from, to string) {
+			transitions = append(transitions, from+">"+to)
+		},
+	}}
+
+	// a slow request is allowed while the circuit is closed.
+	slow, ok := c.allow()
+	if !ok || slow {
+		t.Fatalf("expected a request that is not a probe got %t %t", slow, ok)
+	}
+
+	f, _ := c.allow()
+	c.done(f, false)
+
+	time.Sleep(30 * time.Millisecond)
+
+	probe, ok := c.allow()
+	if !ok || !probe {
+		t.Fatalf("expected the probe got %t %t", probe, ok)
+	}
+
+	// the slow request finishing doesn't close the half-open circuit.
+	c.done(slow, true)
+	if c.state != CircuitHalfOpen {
+		t.Errorf("expected %s got %s", CircuitHalfOpen, c.state)
+	}
+
+	if _, ok := c.allow(); ok {
+		t.Error("expected requests to be blocked while probing")
+	}
+
+	// the probe result is used.
+	c.done(probe, false)
+	if c.state != CircuitOpen {
+		t.Errorf("expected %s got %s", CircuitOpen, c.state)
+	}
+
+	expected := "closed>open open>half-open half-open>open"
+	if s := strings.Join(transitions, " "); s != expected {
+		t.Errorf("expected transitions %s got %s", expected, s)
+	}
+}
@@ -0,0 +1,187 @@
+package weft
+
+import (
+	"encoding/hex"
+	"hash/fnv"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PreconditionFailed is for requests where a precondition such as a resource version doesn't match.
+func PreconditionFailed(message string) *Result {
+	return &Result{Ok: false, Code: http.StatusPreconditionFailed, Msg: message}
+}
+
+// PreconditionRequired is for unsafe requests that must be conditional to avoid lost updates.
+func PreconditionRequired(message string) *Result {
+	return &Result{Ok: false, Code: http.StatusPreconditionRequired, Msg: message}
+}
+
+/*
+RequirePrecondition returns PreconditionRequired for unsafe requests e.g., PUT or DELETE,
+without an If-Match or If-Unmodified-Since header.  It does not check the header values.
+Otherwise StatusOK is returned.
+*/
+func RequirePrecondition(r *http.Request) *Result {
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS", "TRACE":
+		return &StatusOK
+	}
+
+	if r.Header.Get("If-Match") == "" && r.Header.Get("If-Unmodified-Since") == "" {
+		return PreconditionRequired("precondition required: set If-Match or If-Unmodified-Since")
+	}
+
+	return &StatusOK
+}
+
+/*
+CheckVersion is for optimistic locking with a version field in a request body.
+It returns PreconditionFailed if submitted does not match the current version of the resource.
+*/
+func CheckVersion(current, submitted int) *Result {
+	if current != submitted {
+		return PreconditionFailed("version mismatch: expected version " + strconv.Itoa(current) +
+			" got " + strconv.Itoa(submitted))
+	}
+
+	return &StatusOK
+}
+
+/*
+NotModified is for responding to a conditional request when the client's cached copy is current.
+Ok is false so that it is returned by the usual checks in a handler.  http.StatusNotModified
+is written to the client with headers and no body.
+*/
+func NotModified() *Result {
+	return &Result{Ok: false, Code: http.StatusNotModified}
+}
+
+/*
+CheckNotModified is for handlers to call before building a response.  It returns NotModified
+for GET and HEAD requests when the If-None-Match header matches etag or, when there is no
+If-None-Match header, the If-Modified-Since header is not before lastMod.  Empty etag
+and zero lastMod are not checked.  Otherwise StatusOK is returned e.g.,
+
+	if res := weft.CheckNotModified(r, etag, mod); !res.Ok {
+		return res
+	}
+
+The handler should set the ETag and Last-Modified headers before returning either result.
+*/
+func CheckNotModified(r *http.Request, etag string, lastMod time.Time) *Result {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return &StatusOK
+	}
+
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if etagMatch(inm, etag) {
+			return NotModified()
+		}
+		return &StatusOK
+	}
+
+	if lastMod.IsZero() {
+		return &StatusOK
+	}
+
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return &StatusOK
+	}
+
+	if !lastMod.Truncate(time.Second).After(ims) {
+		return NotModified()
+	}
+
+	return &StatusOK
+}
+
+/*
+LatestModified returns the latest of times e.g., the modification times of the resources
+aggregated in a composite response, for use as Result.Modified.  Zero times are ignored.
+The zero time is returned if there are no non zero times, which disables Last-Modified.
+*/
+func LatestModified(times ...time.Time) time.Time {
+	var l time.Time
+
+	for _, t := range times {
+		if t.After(l) {
+			l = t
+		}
+	}
+
+	return l
+}
+
+// etag returns a strong ETag for b from its 64 bit FNV-1a hash.
+func etag(b []byte) string {
+	h := fnv.New64a()
+	h.Write(b)
+	return `"` + hex.EncodeToString(h.Sum(nil)) + `"`
+}
+
+// etagMatch returns true if etag matches any of the entity tags in the
+// If-None-Match header value inm.  Uses the weak comparison from RFC 7232.
+func etagMatch(inm, etag string) bool {
+	if etag == "" {
+		return false
+	}
+
+	etag = strings.TrimPrefix(etag, "W/")
+
+	for _, t := range strings.Split(inm, ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+		if t == "*" || t == etag || trimETagSuffix(t) == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// etagSuffix returns etag with -encoding appended inside the quotes e.g., "abc" becomes "abc-gzip".
+// Used to give compressed variants of a response a different ETag to the uncompressed response.
+func etagSuffix(etag, encoding string) string {
+	if etag == "" {
+		return ""
+	}
+
+	if strings.HasSuffix(etag, `"`) {
+		return etag[:len(etag)-1] + "-" + encoding + `"`
+	}
+
+	return etag + "-" + encoding
+}
+
+// trimETagSuffix removes any suffix added to etag by etagSuffix for the built in encodings or a registered compressor.
+func trimETagSuffix(etag string) string {
+	q := strings.HasSuffix(etag, `"`)
+	e := strings.TrimSuffix(etag, `"`)
+
+	encodings := []string{"gzip", "br", "deflate"}
+	for _, c := range compressors {
+		encodings = append(encodings, c.encoding)
+	}
+
+	for _, enc := range encodings {
+		if strings.HasSuffix(e, "-"+enc) {
+			e = strings.TrimSuffix(e, "-"+enc)
+			if q {
+				e += `"`
+			}
+			return e
+		}
+	}
+
+	return etag
+}
+
+// notModified returns true if r is a GET or HEAD request with an If-None-Match
+// header that matches the ETag set in h or, when there is no If-None-Match header,
+// an If-Modified-Since header that is not before modified.  See CheckNotModified.
+func notModified(r *http.Request, h http.Header, modified time.Time) bool {
+	return CheckNotModified(r, h.Get("ETag"), modified).Code == http.StatusNotModified
+}
@@ -0,0 +1,483 @@
+package weft
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNotModified(t *testing.T) {
+	var bodies int
+
+	h := func(r *http.Request, h http.Header, b *bytes.Buffer) *Result {
+		h.Set("ETag", `"v1"`)
+		if b != nil {
+			bodies++
+			b.WriteString("bogan impsum bogan impsum")
+		}
+		return &StatusOK
+	}
+
+	in := []struct {
+		method      string
+		ifNoneMatch string
+		code        int
+		bodies      int
+	}{
+		{"HEAD", `"v1"`, http.StatusNotModified, 1},
+		{"HEAD", `W/"v1"`, http.StatusNotModified, 1},
+		{"HEAD", `"v0", "v1"`, http.StatusNotModified, 1},
+		{"HEAD", `*`, http.StatusNotModified, 1},
+		{"HEAD", `"v0"`, http.StatusOK, 1},
+		{"HEAD", "", http.StatusOK, 1},
+		{"GET", `"v1"`, http.StatusNotModified, 1},
+		{"GET", `"v1-gzip"`, http.StatusNotModified, 1},
+		{"GET", `W/"v1-gzip"`, http.StatusNotModified, 1},
+		{"GET", `"v0"`, http.StatusOK, 1},
+		{"PUT", `"v1"`, http.StatusOK, 0},
+	}
+
+	for _, v := range in {
+		r, err := http.NewRequest(v.method, "http://test.com", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if v.ifNoneMatch != "" {
+			r.Header.Set("If-None-Match", v.ifNoneMatch)
+		}
+
+		bodies = 0
+
+		w := httptest.NewRecorder()
+		MakeHandlerAPI(h).ServeHTTP(w, r)
+
+		if w.Code != v.code {
+			t.Errorf("%s If-None-Match: %s expected status %d got %d", v.method, v.ifNoneMatch, v.code, w.Code)
+		}
+
+		if bodies != v.bodies {
+			t.Errorf("%s If-None-Match: %s expected %d bodies got %d", v.method, v.ifNoneMatch, v.bodies, bodies)
+		}
+
+		if w.Code == http.StatusNotModified && w.Body.Len() != 0 {
+			t.Errorf("%s If-None-Match: %s expected empty body for 304", v.method, v.ifNoneMatch)
+		}
+	}
+}
+
+func TestETagGzip(t *testing.T) {
+	h := func(r *http.Request, h http.Header, b *bytes.Buffer) *Result {
+		h.Set("ETag", `"v1"`)
+		h.Set("Content-Type", "text/plain")
+		b.WriteString("bogan impsum bogan impsum")
+		return &StatusOK
+	}
+
+	r := httptest.NewRequest("GET", "http://test.com", nil)
+
+	w := httptest.NewRecorder()
+	MakeHandlerAPI(h).ServeHTTP(w, r)
+	checkResponse(t, w, http.StatusOK, "max-age=10", "", "bogan impsum bogan impsum")
+
+	identity := w.Header().Get("ETag")
+	if identity != `"v1"` {
+		t.Errorf(`expected ETag "v1" got %s`, identity)
+	}
+
+	r.Header.Set("Accept-Encoding", "gzip")
+
+	w = httptest.NewRecorder()
+	MakeHandlerAPI(h).ServeHTTP(w, r)
+	checkResponse(t, w, http.StatusOK, "max-age=10", "gzip", "bogan impsum bogan impsum")
+
+	gz := w.Header().Get("ETag")
+	if gz != `"v1-gzip"` {
+		t.Errorf(`expected ETag "v1-gzip" got %s`, gz)
+	}
+
+	if gz == identity {
+		t.Error("expected different ETags for gzip and identity responses")
+	}
+
+	in := []struct {
+		etag, encoding, suffixed string
+	}{
+		{`"v1"`, "gzip", `"v1-gzip"`},
+		{`W/"v1"`, "gzip", `W/"v1-gzip"`},
+		{`v1`, "br", `v1-br`},
+		{``, "gzip", ``},
+	}
+
+	for _, v := range in {
+		if s := etagSuffix(v.etag, v.encoding); s != v.suffixed {
+			t.Errorf("%s %s expected %s got %s", v.etag, v.encoding, v.suffixed, s)
+		}
+	}
+}
+
+func TestETagNotModifiedVariant(t *testing.T) {
+	h := func(r *http.Request, h http.Header, b *bytes.Buffer) *Result {
+		h.Set("Content-Type", "text/plain")
+		b.WriteString("bogan impsum bogan impsum")
+		return &StatusOK
+	}
+
+	for _, enc := range []string{"", "gzip", "br", "deflate"} {
+		r := httptest.NewRequest("GET", "http://test.com", nil)
+		r.Header.Set("Accept-Encoding", enc)
+
+		w := httptest.NewRecorder()
+		MakeHandlerAPI(h).ServeHTTP(w, r)
+
+		variant := w.Header().Get("ETag")
+
+		// revalidate the stored variant
+		r.Header.Set("If-None-Match", variant)
+
+		w = httptest.NewRecorder()
+		MakeHandlerAPI(h).ServeHTTP(w, r)
+
+		if w.Code != http.StatusNotModified {
+			t.Errorf("%q expected status %d got %d", enc, http.StatusNotModified, w.Code)
+		}
+
+		if e := w.Header().Get("ETag"); e != variant {
+			t.Errorf("%q expected 304 ETag %s got %s", enc, variant, e)
+		}
+	}
+}
+
+func TestCheckNotModified(t *testing.T) {
+	mod := time.Date(2016, 1, 2, 3, 4, 5, 500, time.UTC)
+
+	in := []struct {
+		method          string
+		ifNoneMatch     string
+		ifModifiedSince string
+		etag            string
+		lastMod         time.Time
+		code            int
+	}{
+		{"GET", `"v1"`, "", `"v1"`, mod, http.StatusNotModified},
+		{"HEAD", `W/"v1"`, "", `"v1"`, time.Time{}, http.StatusNotModified},
+		{"GET", `"v0"`, "", `"v1"`, mod, http.StatusOK},
+		{"GET", "", "Sat, 02 Jan 2016 03:04:05 GMT", `"v1"`, mod, http.StatusNotModified},
+		{"GET", "", "Sat, 02 Jan 2016 04:00:00 GMT", "", mod, http.StatusNotModified},
+		{"GET", "", "Sat, 02 Jan 2016 03:04:04 GMT", `"v1"`, mod, http.StatusOK},
+		{"GET", "", "Sat, 02 Jan 2016 03:04:05 GMT", `"v1"`, time.Time{}, http.StatusOK},
+		{"GET", "", "yesterday", `"v1"`, mod, http.StatusOK},
+		// If-None-Match takes precedence over If-Modified-Since.
+		{"GET", `"v0"`, "Sat, 02 Jan 2016 04:00:00 GMT", `"v1"`, mod, http.StatusOK},
+		{"GET", "", "", `"v1"`, mod, http.StatusOK},
+		{"PUT", `"v1"`, "", `"v1"`, mod, http.StatusOK},
+	}
+
+	for _, v := range in {
+		r := httptest.NewRequest(v.method, "http://test.com", nil)
+		if v.ifNoneMatch != "" {
+			r.Header.Set("If-None-Match", v.ifNoneMatch)
+		}
+		if v.ifModifiedSince != "" {
+			r.Header.Set("If-Modified-Since", v.ifModifiedSince)
+		}
+
+		if res := CheckNotModified(r, v.etag, v.lastMod); res.Code != v.code {
+			t.Errorf("%s If-None-Match: %s If-Modified-Since: %s expected code %d got %d",
+				v.method, v.ifNoneMatch, v.ifModifiedSince, v.code, res.Code)
+		}
+	}
+
+	// the handler returns before building the body.
+	var bodies int
+
+	h := func(r *http.Request, h http.Header, b *bytes.Buffer) *Result {
+		h.Set("ETag", `"v1"`)
+		if res := CheckNotModified(r, `"v1"`, time.Time{}); !res.Ok {
+			return res
+		}
+		bodies++
+		b.WriteString("bogan impsum bogan impsum")
+		return &StatusOK
+	}
+
+	r := httptest.NewRequest("GET", "http://test.com", nil)
+	r.Header.Set("If-None-Match", `"v1"`)
+
+	w := httptest.NewRecorder()
+	MakeHandlerAPI(h).ServeHTTP(w, r)
+
+	if w.Code != http.StatusNotModified {
+		t.Errorf("expected status %d got %d", http.StatusNotModified, w.Code)
+	}
+
+	if bodies != 0 {
+		t.Error("expected no body to be built")
+	}
+
+	if w.Body.Len() != 0 {
+		t.Error("expected empty body for 304")
+	}
+
+	if w.Header().Get("ETag") != `"v1"` {
+		t.Error("expected ETag header on 304")
+	}
+
+	// Write
+	w = httptest.NewRecorder()
+	Write(w, httptest.NewRequest("GET", "http://test.com", nil), NotModified())
+
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("Write expected empty %d got %d %s", http.StatusNotModified, w.Code, w.Body.String())
+	}
+}
+
+func TestWriteETag(t *testing.T) {
+	h := func(r *http.Request, h http.Header, b *bytes.Buffer) *Result {
+		h.Set("Content-Type", "text/plain")
+		b.WriteString("bogan impsum bogan impsum")
+		return &StatusOK
+	}
+
+	r := httptest.NewRequest("GET", "http://test.com", nil)
+
+	w := httptest.NewRecorder()
+	MakeHandlerAPI(h).ServeHTTP(w, r)
+	checkResponse(t, w, http.StatusOK, "max-age=10", "", "bogan impsum bogan impsum")
+
+	e := w.Header().Get("ETag")
+	if e != etag([]byte("bogan impsum bogan impsum")) || len(e) != 18 {
+		t.Errorf("expected strong ETag of the body got %s", e)
+	}
+
+	// the ETag is computed before gzipping.
+	r.Header.Set("Accept-Encoding", "gzip")
+
+	w = httptest.NewRecorder()
+	MakeHandlerAPI(h).ServeHTTP(w, r)
+	checkResponse(t, w, http.StatusOK, "max-age=10", "gzip", "bogan impsum bogan impsum")
+
+	if w.Header().Get("ETag") != etagSuffix(e, "gzip") {
+		t.Errorf("expected ETag %s got %s", etagSuffix(e, "gzip"), w.Header().Get("ETag"))
+	}
+
+	// a matching If-None-Match gets 304 with no body.
+	for _, inm := range []string{e, etagSuffix(e, "gzip")} {
+		r.Header.Set("If-None-Match", inm)
+
+		w = httptest.NewRecorder()
+		MakeHandlerAPI(h).ServeHTTP(w, r)
+
+		if w.Code != http.StatusNotModified {
+			t.Errorf("If-None-Match: %s expected status %d got %d", inm, http.StatusNotModified, w.Code)
+		}
+
+		if w.Body.Len() != 0 {
+			t.Errorf("If-None-Match: %s expected empty body for 304", inm)
+		}
+	}
+
+	// changed content does not match.
+	r.Header.Set("If-None-Match", etag([]byte("bogan impsum")))
+
+	w = httptest.NewRecorder()
+	MakeHandlerAPI(h).ServeHTTP(w, r)
+	checkResponse(t, w, http.StatusOK, "max-age=10", "gzip", "bogan impsum bogan impsum")
+
+	// no ETag for errors or empty bodies.
+	for _, res := range []*Result{&NotFound, &StatusOK} {
+		res := res
+		w = httptest.NewRecorder()
+		MakeHandlerAPI(func(r *http.Request, h http.Header, b *bytes.Buffer) *Result {
+			return res
+		}).ServeHTTP(w, httptest.NewRequest("GET", "http://test.com", nil))
+
+		if w.Header().Get("ETag") != "" {
+			t.Errorf("%d expected no ETag got %s", res.Code, w.Header().Get("ETag"))
+		}
+	}
+}
+
+func TestWriteModified(t *testing.T) {
+	mod := time.Date(2016, 1, 2, 3, 4, 5, 500, time.FixedZone("NZDT", 13*3600))
+
+	in := []struct {
+		modified        time.Time
+		ifModifiedSince string
+		code            int
+	}{
+		{mod, "", http.StatusOK},
+		{mod, "Fri, 01 Jan 2016 14:04:05 GMT", http.StatusNotModified},
+		{mod, "Fri, 01 Jan 2016 15:00:00 GMT", http.StatusNotModified},
+		{mod, "Fri, 01 Jan 2016 14:04:04 GMT", http.StatusOK},
+		{mod, "not a date", http.StatusOK},
+		{time.Time{}, "Fri, 01 Jan 2016 15:00:00 GMT", http.StatusOK},
+	}
+
+	for _, v := range in {
+		r := httptest.NewRequest("GET", "http://test.com", nil)
+		if v.ifModifiedSince != "" {
+			r.Header.Set("If-Modified-Since", v.ifModifiedSince)
+		}
+
+		res := Result{Ok: true, Code: http.StatusOK, Modified: v.modified}
+
+		var b bytes.Buffer
+		b.WriteString("bogan impsum")
+
+		w := httptest.NewRecorder()
+		WriteBytes(w, r, &res, &b, false)
+
+		if w.Code != v.code {
+			t.Errorf("WriteBytes If-Modified-Since: %s expected status %d got %d", v.ifModifiedSince, v.code, w.Code)
+		}
+
+		if v.code == http.StatusNotModified && w.Body.Len() != 0 {
+			t.Errorf("WriteBytes If-Modified-Since: %s expected empty body for 304", v.ifModifiedSince)
+		}
+
+		lm := "Fri, 01 Jan 2016 14:04:05 GMT"
+		if v.modified.IsZero() {
+			lm = ""
+		}
+
+		if w.Header().Get("Last-Modified") != lm {
+			t.Errorf("WriteBytes expected Last-Modified %q got %q", lm, w.Header().Get("Last-Modified"))
+		}
+
+		w = httptest.NewRecorder()
+		Write(w, r, &res)
+
+		if w.Code != v.code {
+			t.Errorf("Write If-Modified-Since: %s expected status %d got %d", v.ifModifiedSince, v.code, w.Code)
+		}
+
+		if w.Header().Get("Last-Modified") != lm {
+			t.Errorf("Write expected Last-Modified %q got %q", lm, w.Header().Get("Last-Modified"))
+		}
+	}
+}
+
+func TestLatestModified(t *testing.T) {
+	quake := time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)
+	felt := time.Date(2016, 1, 2, 3, 10, 0, 0, time.UTC)
+	// same instant as felt in another zone
+	feltNZ := felt.In(time.FixedZone("NZDT", 13*3600))
+	shaking := time.Date(2016, 1, 2, 3, 5, 30, 0, time.UTC)
+
+	in := []struct {
+		id       string
+		times    []time.Time
+		expected time.Time
+	}{
+		{"none", nil, time.Time{}},
+		{"zero", []time.Time{{}}, time.Time{}},
+		{"single", []time.Time{quake}, quake},
+		{"latest last", []time.Time{quake, shaking, felt}, felt},
+		{"latest first", []time.Time{felt, quake, shaking}, felt},
+		{"zones", []time.Time{quake, feltNZ}, feltNZ},
+		{"zero ignored", []time.Time{{}, quake, {}}, quake},
+	}
+
+	for _, v := range in {
+		if l := LatestModified(v.times...); !l.Equal(v.expected) {
+			t.Errorf("%s expected %s got %s", v.id, v.expected, l)
+		}
+	}
+
+	// a composite response is not modified until any part is modified.
+	h := func(r *http.Request, h http.Header, b *bytes.Buffer) *Result {
+		b.WriteString("bogan impsum")
+		return &Result{Ok: true, Code: http.StatusOK, Modified: LatestModified(quake, felt, shaking)}
+	}
+
+	codes := []struct {
+		ifModifiedSince string
+		code            int
+	}{
+		{"", http.StatusOK},
+		{"Sat, 02 Jan 2016 03:10:00 GMT", http.StatusNotModified},
+		{"Sat, 02 Jan 2016 04:00:00 GMT", http.StatusNotModified},
+		{"Sat, 02 Jan 2016 03:05:30 GMT", http.StatusOK},
+		{"Sat, 02 Jan 2016 03:09:59 GMT", http.StatusOK},
+	}
+
+	for _, v := range codes {
+		r := httptest.NewRequest("GET", "http://test.com", nil)
+		if v.ifModifiedSince != "" {
+			r.Header.Set("If-Modified-Since", v.ifModifiedSince)
+		}
+
+		w := httptest.NewRecorder()
+		MakeHandlerAPI(h).ServeHTTP(w, r)
+
+		if w.Code != v.code {
+			t.Errorf("If-Modified-Since: %s expected status %d got %d", v.ifModifiedSince, v.code, w.Code)
+		}
+
+		if w.Header().Get("Last-Modified") != "Sat, 02 Jan 2016 03:10:00 GMT" {
+			t.Errorf("If-Modified-Since: %s wrong Last-Modified %s", v.ifModifiedSince, w.Header().Get("Last-Modified"))
+		}
+	}
+}
+
+func TestCheckVersion(t *testing.T) {
+	if res := CheckVersion(3, 3); !res.Ok {
+		t.Errorf("expected ok for matching versions got %d", res.Code)
+	}
+
+	res := CheckVersion(3, 2)
+	if res.Code != http.StatusPreconditionFailed {
+		t.Errorf("expected code %d got %d", http.StatusPreconditionFailed, res.Code)
+	}
+
+	if res.Msg != "version mismatch: expected version 3 got 2" {
+		t.Errorf("wrong message %s", res.Msg)
+	}
+}
+
+func TestRequirePrecondition(t *testing.T) {
+	in := []struct {
+		method string
+		header string
+		value  string
+		code   int
+	}{
+		{"PUT", "", "", http.StatusPreconditionRequired},
+		{"DELETE", "", "", http.StatusPreconditionRequired},
+		{"PATCH", "If-None-Match", `"abc"`, http.StatusPreconditionRequired},
+		{"PUT", "If-Match", `"abc"`, http.StatusOK},
+		{"DELETE", "If-Unmodified-Since", "Sat, 02 Jan 2016 03:04:05 GMT", http.StatusOK},
+		{"GET", "", "", http.StatusOK},
+		{"HEAD", "", "", http.StatusOK},
+	}
+
+	for _, v := range in {
+		r := httptest.NewRequest(v.method, "http://test.com", nil)
+		if v.header != "" {
+			r.Header.Set(v.header, v.value)
+		}
+
+		if res := RequirePrecondition(r); res.Code != v.code {
+			t.Errorf("%s %s expected code %d got %d", v.method, v.header, v.code, res.Code)
+		}
+	}
+
+	// written to the client
+	h := func(r *http.Request, h http.Header, b *bytes.Buffer) *Result {
+		return RequirePrecondition(r)
+	}
+
+	w := httptest.NewRecorder()
+	MakeHandlerAPI(h).ServeHTTP(w, httptest.NewRequest("PUT", "http://test.com", nil))
+
+	if w.Code != http.StatusPreconditionRequired {
+		t.Errorf("expected status %d got %d", http.StatusPreconditionRequired, w.Code)
+	}
+
+	if w.Body.String() != "precondition required: set If-Match or If-Unmodified-Since" {
+		t.Errorf("wrong body %s", w.Body.String())
+	}
+}
@@ -0,0 +1,93 @@
+package weft
+
+import (
+	"net/http"
+	"strings"
+)
+
+// CORSOptions configures MakeHandlerCORS.
+type CORSOptions struct {
+	Origins []string // allowed origins e.g., https://www.geonet.org.nz, https://*.geonet.org.nz, or * for any origin
+	Methods []string // methods allowed in preflight requests e.g., GET, PUT
+	Headers []string // request headers allowed in preflight requests e.g., Content-Type
+}
+
+/*
+MakeHandlerCORS is MakeHandlerAPI with Cross-Origin Resource Sharing for browsers e.g.,
+for a single page app served from another origin
+
+	http.Handle("/quake", weft.MakeHandlerCORS(quakeHandler, weft.CORSOptions{
+		Origins: []string{"https://*.geonet.org.nz"},
+		Methods: []string{"GET", "PUT"},
+		Headers: []string{"Content-Type"},
+	}))
+
+When the Origin header of a request matches one of opts.Origins the
+Access-Control-Allow-Origin header is set on the response.  An origin of * matches any
+origin and a * in an origin matches any part of the host e.g., https://*.geonet.org.nz.
+
+Preflight requests (OPTIONS with an Access-Control-Request-Method header) are answered with
+http.StatusNoContent, without calling f, and when the origin matches have the
+Access-Control-Allow-Methods and Access-Control-Allow-Headers headers set from opts.
+Responses from origins that don't match have no CORS headers so the browser blocks them.
+*/
+func MakeHandlerCORS(f RequestHandler, opts CORSOptions) http.HandlerFunc {
+	api := MakeHandlerAPI(f)
+	methods := strings.Join(opts.Methods, ", ")
+	headers := strings.Join(opts.Headers, ", ")
+	anyOrigin := contains(opts.Origins, "*")
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		o := r.Header.Get("Origin")
+
+		switch {
+		case anyOrigin:
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		case o != "" && allowedOrigin(opts.Origins, o):
+			w.Header().Set("Access-Control-Allow-Origin", o)
+			AddVary(w.Header(), "Origin")
+		default:
+			AddVary(w.Header(), "Origin")
+		}
+
+		if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+			if w.Header().Get("Access-Control-Allow-Origin") != "" {
+				if methods != "" {
+					w.Header().Set("Access-Control-Allow-Methods", methods)
+				}
+				if headers != "" {
+					w.Header().Set("Access-Control-Allow-Headers", headers)
+				}
+			}
+
+			Write(w, r, &NoContent)
+			return
+		}
+
+		api(w, r)
+	}
+}
+
+// allowedOrigin returns true if o matches one of allowed.  A * in allowed matches any characters.
+func allowedOrigin(allowed []string, o string) bool {
+	o = strings.ToLower(o)
+
+	for _, a := range allowed {
+		a = strings.ToLower(a)
+
+		i := strings.Index(a, "*")
+		if i < 0 {
+			if a == o {
+				return true
+			}
+			continue
+		}
+
+		prefix, suffix := a[:i], a[i+1:]
+		if len(o) >= len(prefix)+len(suffix) && strings.HasPrefix(o, prefix) && strings.HasSuffix(o, suffix) {
+			return true
+		}
+	}
+
+	return false
+}
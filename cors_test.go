@@ -0,0 +1,104 @@
+package weft
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMakeHandlerCORS(t *testing.T) {
+	var calls int
+
+	h := func(r *http.Request, h http.Header, b *bytes.Buffer) *Result {
+		calls++
+		if b != nil {
+			b.WriteString("bogan impsum")
+		}
+		return &StatusOK
+	}
+
+	opts := CORSOptions{
+		Origins: []string{"https://www.geonet.org.nz", "https://*.example.com"},
+		Methods: []string{"GET", "PUT"},
+		Headers: []string{"Content-Type", "X-Feature-Flags"},
+	}
+
+	in := []struct {
+		id            string
+		method        string
+		origin        string
+		requestMethod string
+		code          int
+		allowOrigin   string
+		allowMethods  string
+		allowHeaders  string
+		calls         int
+	}{
+		{"preflight", "OPTIONS", "https://www.geonet.org.nz", "PUT", http.StatusNoContent, "https://www.geonet.org.nz", "GET, PUT", "Content-Type, X-Feature-Flags", 0},
+		{"preflight wildcard", "OPTIONS", "https://app.example.com", "GET", http.StatusNoContent, "https://app.example.com", "GET, PUT", "Content-Type, X-Feature-Flags", 0},
+		{"preflight not allowed", "OPTIONS", "https://evil.example.org", "GET", http.StatusNoContent, "", "", "", 0},
+		{"get", "GET", "https://www.geonet.org.nz", "", http.StatusOK, "https://www.geonet.org.nz", "", "", 1},
+		{"get case", "GET", "HTTPS://WWW.GEONET.ORG.NZ", "", http.StatusOK, "HTTPS://WWW.GEONET.ORG.NZ", "", "", 1},
+		{"get wildcard", "GET", "https://a.b.example.com", "", http.StatusOK, "https://a.b.example.com", "", "", 1},
+		{"get wildcard no host", "GET", "https://example.com", "", http.StatusOK, "", "", "", 1},
+		{"get not allowed", "GET", "https://www.geonet.org.nz.evil.org", "", http.StatusOK, "", "", "", 1},
+		{"get same origin", "GET", "", "", http.StatusOK, "", "", "", 1},
+		{"put", "PUT", "https://www.geonet.org.nz", "", http.StatusOK, "https://www.geonet.org.nz", "", "", 1},
+		{"options not preflight", "OPTIONS", "https://www.geonet.org.nz", "", http.StatusOK, "https://www.geonet.org.nz", "", "", 1},
+	}
+
+	for _, v := range in {
+		r := httptest.NewRequest(v.method, "http://test.com", nil)
+		if v.origin != "" {
+			r.Header.Set("Origin", v.origin)
+		}
+		if v.requestMethod != "" {
+			r.Header.Set("Access-Control-Request-Method", v.requestMethod)
+		}
+
+		calls = 0
+
+		w := httptest.NewRecorder()
+		MakeHandlerCORS(h, opts).ServeHTTP(w, r)
+
+		if w.Code != v.code {
+			t.Errorf("%s expected status %d got %d", v.id, v.code, w.Code)
+		}
+
+		if calls != v.calls {
+			t.Errorf("%s expected %d calls got %d", v.id, v.calls, calls)
+		}
+
+		if s := w.Header().Get("Access-Control-Allow-Origin"); s != v.allowOrigin {
+			t.Errorf("%s expected Access-Control-Allow-Origin %q got %q", v.id, v.allowOrigin, s)
+		}
+
+		if s := w.Header().Get("Access-Control-Allow-Methods"); s != v.allowMethods {
+			t.Errorf("%s expected Access-Control-Allow-Methods %q got %q", v.id, v.allowMethods, s)
+		}
+
+		if s := w.Header().Get("Access-Control-Allow-Headers"); s != v.allowHeaders {
+			t.Errorf("%s expected Access-Control-Allow-Headers %q got %q", v.id, v.allowHeaders, s)
+		}
+
+		if s := w.Header().Get("Vary"); s != "Origin" && s != "Origin, Accept-Encoding" {
+			t.Errorf("%s expected Vary to include Origin got %q", v.id, s)
+		}
+	}
+
+	// any origin
+	r := httptest.NewRequest("GET", "http://test.com", nil)
+	r.Header.Set("Origin", "https://anywhere.org")
+
+	w := httptest.NewRecorder()
+	MakeHandlerCORS(h, CORSOptions{Origins: []string{"*"}}).ServeHTTP(w, r)
+
+	if s := w.Header().Get("Access-Control-Allow-Origin"); s != "*" {
+		t.Errorf("expected Access-Control-Allow-Origin * got %q", s)
+	}
+
+	if s := w.Header().Get("Vary"); s != "Accept-Encoding" {
+		t.Errorf("expected Vary Accept-Encoding got %q", s)
+	}
+}
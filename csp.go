@@ -0,0 +1,59 @@
+package weft
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"strings"
+)
+
+type nonceKey struct{}
+
+// newNonce returns a random nonce for use in a Content-Security-Policy.
+func newNonce() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return base64.StdEncoding.EncodeToString(b[:])
+}
+
+// withNonce returns a copy of r with a new nonce in its context and the nonce.
+func withNonce(r *http.Request) (*http.Request, string) {
+	n := newNonce()
+	return r.WithContext(context.WithValue(r.Context(), nonceKey{}, n)), n
+}
+
+/*
+Nonce returns the Content-Security-Policy nonce for r or an empty string if there is none.
+Handlers made with MakeHandlerPage are passed requests with a nonce that is unique for each
+response.  Use it in inline script and style tags e.g.,
+
+	<script nonce="{{.Nonce}}">
+*/
+func Nonce(r *http.Request) string {
+	n, _ := r.Context().Value(nonceKey{}).(string)
+	return n
+}
+
+/*
+PageCSP is the Content-Security-Policy for HTML responses from MakeHandlerPage.  {nonce} is
+replaced with the nonce from Nonce(r).  The default allows same origin scripts and stylesheets
+and inline script and style tags with the nonce.  Loosen it for pages that load images, fonts,
+or scripts from other origins e.g.,
+
+	weft.PageCSP = "default-src 'self' https://*.geonet.org.nz; script-src 'self' 'nonce-{nonce}'"
+
+An empty PageCSP disables the header.  Set during init.
+*/
+var PageCSP = "default-src 'self'; script-src 'self' 'nonce-{nonce}'; style-src 'self' 'nonce-{nonce}'; object-src 'none'; base-uri 'self'"
+
+// csp returns PageCSP with nonce.
+func csp(nonce string) string {
+	return strings.Replace(PageCSP, "{nonce}", nonce, -1)
+}
+
+// errorCSP returns a Content-Security-Policy for error pages.  They only have inline style
+// tags so only tags with nonce are allowed.
+func errorCSP(nonce string) string {
+	return "default-src 'self'; script-src 'nonce-" + nonce + "'; style-src 'nonce-" + nonce + "'; object-src 'none'; base-uri 'self'"
+}
@@ -0,0 +1,158 @@
+package weft
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNonce(t *testing.T) {
+	r, err := http.NewRequest("GET", "http://test.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if Nonce(r) != "" {
+		t.Error("expected no nonce for a request not from MakeHandlerPage")
+	}
+
+	h := func(r *http.Request, h http.Header, b *bytes.Buffer) *Result {
+		b.WriteString(`<html><script nonce="` + Nonce(r) + `"></script></html>`)
+		return &StatusOK
+	}
+
+	seen := make(map[string]bool)
+
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		MakeHandlerPage(h).ServeHTTP(w, r)
+
+		c := w.Header().Get("Content-Security-Policy")
+
+		i := strings.Index(c, "'nonce-")
+		if i < 0 {
+			t.Fatalf("no nonce in Content-Security-Policy %s", c)
+		}
+		n := c[i+7:]
+		n = n[:strings.Index(n, "'")]
+
+		if n == "" {
+			t.Fatal("empty nonce")
+		}
+
+		if seen[n] {
+			t.Errorf("nonce %s repeated", n)
+		}
+		seen[n] = true
+
+		if !strings.Contains(w.Body.String(), `<script nonce="`+n+`">`) {
+			t.Errorf("nonce %s not in page %s", n, w.Body.String())
+		}
+	}
+
+	// error pages
+	h = func(r *http.Request, h http.Header, b *bytes.Buffer) *Result {
+		return &NotFound
+	}
+
+	w := httptest.NewRecorder()
+	MakeHandlerPage(h).ServeHTTP(w, r)
+
+	c := w.Header().Get("Content-Security-Policy")
+
+	i := strings.Index(c, "'nonce-")
+	if i < 0 {
+		t.Fatalf("no nonce in Content-Security-Policy %s", c)
+	}
+	n := c[i+7:]
+	n = n[:strings.Index(n, "'")]
+
+	if seen[n] {
+		t.Errorf("nonce %s repeated", n)
+	}
+
+	if !strings.Contains(w.Body.String(), `<style nonce="`+n+`">`) {
+		t.Errorf("nonce %s not in error page", n)
+	}
+}
+
+func TestCSP(t *testing.T) {
+	ok := func(r *http.Request, h http.Header, b *bytes.Buffer) *Result {
+		b.WriteString(`<html><script src="/app.js"></script></html>`)
+		return &StatusOK
+	}
+
+	notFound := func(r *http.Request, h http.Header, b *bytes.Buffer) *Result {
+		return &NotFound
+	}
+
+	in := []struct {
+		id     string
+		h      RequestHandler
+		script string
+		style  string
+	}{
+		{"page", ok, "script-src 'self' 'nonce-", "style-src 'self' 'nonce-"},
+		{"error page", notFound, "script-src 'nonce-", "style-src 'nonce-"},
+	}
+
+	for _, v := range in {
+		w := httptest.NewRecorder()
+		MakeHandlerPage(v.h).ServeHTTP(w, httptest.NewRequest("GET", "http://test.com", nil))
+
+		c := w.Header().Get("Content-Security-Policy")
+
+		if !strings.Contains(c, v.script) || !strings.Contains(c, v.style) {
+			t.Errorf("%s expected %s and %s in Content-Security-Policy %s", v.id, v.script, v.style, c)
+		}
+	}
+}
+
+func TestPageCSP(t *testing.T) {
+	defer func(p string) { PageCSP = p }(PageCSP)
+
+	page := func(r *http.Request, h http.Header, b *bytes.Buffer) *Result {
+		b.WriteString(`<html><script src="/app.js"></script></html>`)
+		return &StatusOK
+	}
+
+	data := func(r *http.Request, h http.Header, b *bytes.Buffer) *Result {
+		h.Set("Content-Type", "application/json")
+		b.WriteString(`{"bogan":"impsum"}`)
+		return &StatusOK
+	}
+
+	in := []struct {
+		id      string
+		policy  string
+		h       RequestHandler
+		handler func(RequestHandler) http.HandlerFunc
+		csp     string
+	}{
+		{"default", PageCSP, page, MakeHandlerPage, "default-src 'self'; script-src 'self' 'nonce-"},
+		{"custom", "img-src *; script-src 'nonce-{nonce}'", page, MakeHandlerPage, "img-src *; script-src 'nonce-"},
+		{"disabled", "", page, MakeHandlerPage, ""},
+		{"not html", PageCSP, data, MakeHandlerPage, ""},
+		{"api", PageCSP, page, MakeHandlerAPI, ""},
+	}
+
+	for _, v := range in {
+		PageCSP = v.policy
+
+		w := httptest.NewRecorder()
+		v.handler(v.h).ServeHTTP(w, httptest.NewRequest("GET", "http://test.com", nil))
+
+		c := w.Header().Get("Content-Security-Policy")
+
+		switch {
+		case v.csp == "" && c != "":
+			t.Errorf("%s expected no Content-Security-Policy got %s", v.id, c)
+		case v.csp != "" && !strings.HasPrefix(c, v.csp):
+			t.Errorf("%s expected Content-Security-Policy starting %s got %s", v.id, v.csp, c)
+		case strings.Contains(c, "{nonce}"):
+			t.Errorf("%s nonce not replaced in %s", v.id, c)
+		}
+	}
+}
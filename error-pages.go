@@ -1,6 +1,9 @@
 package weft
 
-import "net/http"
+import (
+	"bytes"
+	"net/http"
+)
 
 const (
 	err404 = `<html>
@@ -207,4 +210,33 @@ var errorPages = map[int][]byte{
 	http.StatusMethodNotAllowed: []byte(err405),
 	http.StatusInternalServerError: []byte(err503),
 	http.StatusServiceUnavailable: []byte(err503),
-}
\ No newline at end of file
+}
+
+/*
+SetErrorPage replaces the HTML error page for code used by MakeHandlerPage and WriteBytes
+e.g., for branded pages.  The built in pages are used for codes that are not set.  A
+nonce is added to <style> tags in html as for the built in pages.
+
+Call during init before serving requests.
+*/
+func SetErrorPage(code int, html []byte) {
+	errorPages[code] = html
+}
+
+// renderErrorPage returns the error page for code with nonce added to the style tags.
+// The page for http.StatusInternalServerError is returned for codes without a page.
+// If id is not empty it is added to the end of the page as the request ID.
+func renderErrorPage(code int, nonce, id string) []byte {
+	e, ok := errorPages[code]
+	if !ok {
+		e = errorPages[http.StatusInternalServerError]
+	}
+
+	e = bytes.Replace(e, []byte("<style>"), []byte(`<style nonce="`+nonce+`">`), -1)
+
+	if id != "" {
+		e = bytes.Replace(e, []byte("</body>"), []byte("<p>Request ID: "+id+"</p>\n\t</body>"), 1)
+	}
+
+	return e
+}
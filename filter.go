@@ -0,0 +1,140 @@
+package weft
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+/*
+Filter is a parsed filter expression.  For operators Op is "and", "or", or "not"
+and Args holds the operands.  For terms Op is empty and the term matches Field to Value.
+*/
+type Filter struct {
+	Op    string
+	Args  []Filter
+	Field string
+	Value string
+}
+
+/*
+ParseFilter parses the filter expression in query parameter name of r.
+The grammar is:
+
+	filter = term | op "(" filter { "," filter } ")"
+	op     = "and" | "or" | "not"
+	term   = field ":" value
+
+e.g., and(type:earthquake,or(region:wellington,region:canterbury)).  Fields are letters, digits,
+'_', '-', or '.'.  Values are any characters other than ',', '(', or ')'.  not takes a single filter.
+
+BadRequest is returned for invalid syntax or when operators are nested more than maxDepth deep.
+A zero Filter is returned if the parameter is absent.
+*/
+func ParseFilter(r *http.Request, name string, maxDepth int) (Filter, *Result) {
+	s := r.URL.Query().Get(name)
+	if s == "" {
+		return Filter{}, &StatusOK
+	}
+
+	p := filterParser{s: s, maxDepth: maxDepth}
+
+	f, err := p.filter(0)
+	if err == "" && p.i < len(p.s) {
+		err = "unexpected " + strconv.QuoteRune(rune(p.s[p.i]))
+	}
+
+	if err != "" {
+		return Filter{}, BadRequest("invalid filter " + name + ": " + err + " at offset " + strconv.Itoa(p.i))
+	}
+
+	return f, &StatusOK
+}
+
+type filterParser struct {
+	s        string
+	i        int
+	maxDepth int
+}
+
+// filter parses a filter at depth, returning a non empty error message on failure.
+func (p *filterParser) filter(depth int) (Filter, string) {
+	start := p.i
+
+	for p.i < len(p.s) && isFieldChar(p.s[p.i]) {
+		p.i++
+	}
+
+	word := p.s[start:p.i]
+
+	if p.i >= len(p.s) {
+		return Filter{}, "unexpected end of filter"
+	}
+
+	switch p.s[p.i] {
+	case ':':
+		if word == "" {
+			return Filter{}, "missing field"
+		}
+		p.i++
+
+		v := p.i
+		for p.i < len(p.s) && !strings.ContainsRune(",()", rune(p.s[p.i])) {
+			p.i++
+		}
+
+		if p.i == v {
+			return Filter{}, "missing value"
+		}
+
+		return Filter{Field: word, Value: p.s[v:p.i]}, ""
+	case '(':
+		switch word {
+		case "and", "or", "not":
+		default:
+			p.i = start
+			return Filter{}, "unknown operator " + strconv.Quote(word)
+		}
+
+		if depth >= p.maxDepth {
+			return Filter{}, "nesting deeper than " + strconv.Itoa(p.maxDepth)
+		}
+		p.i++
+
+		f := Filter{Op: word}
+
+		for {
+			a, err := p.filter(depth + 1)
+			if err != "" {
+				return Filter{}, err
+			}
+			f.Args = append(f.Args, a)
+
+			if p.i >= len(p.s) {
+				return Filter{}, "unexpected end of filter"
+			}
+
+			if p.s[p.i] == ')' {
+				p.i++
+				break
+			}
+
+			if p.s[p.i] != ',' {
+				return Filter{}, "expected ',' or ')'"
+			}
+			p.i++
+		}
+
+		if f.Op == "not" && len(f.Args) != 1 {
+			return Filter{}, "not takes a single filter"
+		}
+
+		return f, ""
+	}
+
+	return Filter{}, "unexpected " + strconv.QuoteRune(rune(p.s[p.i]))
+}
+
+func isFieldChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-' || c == '.'
+}
@@ -0,0 +1,61 @@
+package weft
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestParseFilter(t *testing.T) {
+	in := []struct {
+		filter   string
+		expected Filter
+		ok       bool
+	}{
+		{"", Filter{}, true},
+		{"type:earthquake", Filter{Field: "type", Value: "earthquake"}, true},
+		{"and(type:earthquake,or(region:wellington,region:canterbury))", Filter{Op: "and", Args: []Filter{
+			{Field: "type", Value: "earthquake"},
+			{Op: "or", Args: []Filter{
+				{Field: "region", Value: "wellington"},
+				{Field: "region", Value: "canterbury"},
+			}},
+		}}, true},
+		{"not(felt:false)", Filter{Op: "not", Args: []Filter{{Field: "felt", Value: "false"}}}, true},
+		{"time:2016-05-18T04:21:58Z", Filter{Field: "time", Value: "2016-05-18T04:21:58Z"}, true},
+		// too deep for maxDepth 2.
+		{"and(a:1,or(b:2,not(c:3)))", Filter{}, false},
+		// syntax errors.
+		{"type", Filter{}, false},
+		{"type:", Filter{}, false},
+		{":earthquake", Filter{}, false},
+		{"and(type:earthquake", Filter{}, false},
+		{"and(type:earthquake))", Filter{}, false},
+		{"xor(a:1,b:2)", Filter{}, false},
+		{"not(a:1,b:2)", Filter{}, false},
+		{"and(a:1)x:2", Filter{}, false},
+		{"and()", Filter{}, false},
+	}
+
+	for _, v := range in {
+		r, err := http.NewRequest("GET", "http://test.com?filter="+url.QueryEscape(v.filter), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f, res := ParseFilter(r, "filter", 2)
+
+		if res.Ok != v.ok {
+			t.Errorf("%s expected ok %t got %t %s", v.filter, v.ok, res.Ok, res.Msg)
+		}
+
+		if !res.Ok && res.Code != http.StatusBadRequest {
+			t.Errorf("%s expected code %d got %d", v.filter, http.StatusBadRequest, res.Code)
+		}
+
+		if !reflect.DeepEqual(f, v.expected) {
+			t.Errorf("%s expected %+v got %+v", v.filter, v.expected, f)
+		}
+	}
+}
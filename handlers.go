@@ -3,11 +3,20 @@ package weft
 import (
 	"bytes"
 	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"encoding/json"
+	"errors"
 	"github.com/GeoNet/mtr/mtrapp"
+	"github.com/andybalholm/brotli"
+	"io"
 	"log"
 	"net/http"
+	"runtime/debug"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 var bufferPool = sync.Pool{
@@ -44,37 +53,149 @@ var compressibleMimes = map[string]bool{
 }
 
 var surrogateControl = map[int]string{
-	http.StatusNotFound:            "max-age=10",
-	http.StatusServiceUnavailable:  "max-age=10",
-	http.StatusInternalServerError: "max-age=10",
-	http.StatusBadRequest:          "max-age=86400",
-	http.StatusMethodNotAllowed:    "max-age=86400",
+	http.StatusNotFound:                     "max-age=10",
+	http.StatusServiceUnavailable:           "max-age=10",
+	http.StatusInternalServerError:          "max-age=10",
+	http.StatusBadRequest:                   "max-age=86400",
+	http.StatusMethodNotAllowed:             "max-age=86400",
+	http.StatusRequestURITooLong:            "max-age=86400",
+	http.StatusTooManyRequests:              "no-store",
+	http.StatusUnavailableForLegalReasons:   "max-age=86400",
+	http.StatusRequestedRangeNotSatisfiable: "no-store",
+	StatusClientClosedRequest:               "no-store",
 }
 
+type compressor struct {
+	encoding string
+	factory  func(io.Writer) io.WriteCloser
+}
+
+var compressors = map[string]compressor{}
+
+/*
+RegisterCompressor registers a compressor for responses with the Content-Type mime
+e.g., for a codec that suits a particular data format better than gzip.  factory returns
+a writer that compresses to its argument.  It is used when the client accepts encoding,
+which is written to the Content-Encoding header.  Otherwise gzip is used if possible.
+
+Call during init before serving requests.
+*/
+func RegisterCompressor(mime string, factory func(io.Writer) io.WriteCloser, encoding string) {
+	compressors[mime] = compressor{encoding: encoding, factory: factory}
+}
+
+// RegisterCompressibleMime adds mime to the Content-Types that are compressed e.g., application/geo+json.
+// Call during init before serving requests.
+func RegisterCompressibleMime(mime string) {
+	compressibleMimes[mime] = true
+}
+
+// UnregisterCompressibleMime removes mime from the Content-Types that are compressed.
+// Call during init before serving requests.
+func UnregisterCompressibleMime(mime string) {
+	delete(compressibleMimes, mime)
+}
+
+// PostProcess is called by WriteBytes to transform response bodies before they are
+// compressed e.g., to add a common footer to HTML pages.  contentType is the Content-Type
+// of the response.  The returned bytes are written to the client.  Set during init.
+var PostProcess func(contentType string, body []byte) []byte
+
+// MinCompressLength is the smallest response body, in bytes, that is compressed.
+// Bodies of exactly MinCompressLength bytes are compressed.  Shorter bodies are not
+// as the compression overhead outweighs any saving.  Set during init.
+var MinCompressLength = 20
+
+// CompressionLevel is the gzip and deflate compression level for responses e.g.,
+// gzip.BestSpeed or gzip.BestCompression.  Invalid levels use gzip.DefaultCompression.
+// Set during init.
+var CompressionLevel = gzip.DefaultCompression
+
+// CompressFlushSize is the number of uncompressed bytes written to a compressed response
+// between flushes to the client.  Flushing reduces the time to first byte for large
+// responses at the cost of a slightly worse compression ratio.  It applies to br, gzip,
+// and deflate, and to registered compressors that have a Flush() error method.
+// Zero disables flushing.  Set during init.
+var CompressFlushSize = 0
+
+// HopByHopHeaders are removed from responses by WriteBytes and Write, along with any headers
+// named in the Connection header, so that they don't leak through proxies.  The default is the
+// hop-by-hop headers from RFC 7230 and RFC 2616.  Connection: close is kept as net/http uses
+// it to close the connection after the response.  Set during init.
+var HopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"TE",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+var metricsCallback func(path string, code int, d time.Duration)
+
+/*
+SetMetricsCallback sets f to be called after each request served by MakeHandlerPage or
+MakeHandlerAPI with the URL path, the status code, and the wall-clock time taken by the
+RequestHandler and writing the response e.g., to record metrics with Prometheus or statsd.
+A nil f, the default, disables the callback.  Call during init before serving requests.
+*/
+func SetMetricsCallback(f func(path string, code int, d time.Duration)) {
+	metricsCallback = f
+}
+
+/*
+DefaultTimeout is the deadline for handlers made with MakeHandlerPage and MakeHandlerAPI.
+When it is non zero r is passed to the handler with a context that is cancelled after
+DefaultTimeout.  If the deadline is exceeded before the handler returns
+http.StatusServiceUnavailable is written to the client.  Zero disables the deadline.
+
+A handler can apply a shorter deadline by deriving its own context from r.Context().
+Set during init.
+*/
+var DefaultTimeout time.Duration
+
 /*
 MakeHandler executes f and writes the response in b to the client
 with gzipping and Surrogate-Control headers.
 
 HTML error pages are written to the client when res.Code is not http.StatusOK.
+
+HTML responses have a Content-Security-Policy header from PageCSP allowing inline script
+and style tags with the nonce from Nonce(r).  f may set its own Content-Security-Policy.
+
+If f panics the panic is logged with a stack trace and http.StatusInternalServerError
+is written to the client.
 */
 func MakeHandlerPage(f RequestHandler) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		t := mtrapp.Start()
+		start := time.Now()
+
+		r, _ = withNonce(r)
+
+		r, id := withRequestID(r)
+		w.Header().Set("X-Request-Id", id)
+
+		r, cancel := withTimeout(r, DefaultTimeout)
+		defer cancel()
 
 		b := bufferPool.Get().(*bytes.Buffer)
 		defer bufferPool.Put(b)
 		b.Reset()
 
-		res := f(r, w.Header(), b)
+		res := timedOut(r, call(f, r, w.Header(), b))
 		t.Stop()
 		WriteBytes(w, r, res, b, true)
 
+		observe(r, res, start)
 		t.Track(name(f) + "." + r.Method)
 		res.Count()
 
 		// log errors and slow 200s
-		if res.Code != http.StatusOK {
-			log.Printf("status: %d serving %s", res.Code, r.RequestURI)
+		if !success(res.Code) && res.Code != http.StatusNotModified {
+			logStatus(r, res)
 		} else if t.Taken() > 250 {
 			log.Printf("slow: took %d ms serving %s", t.Taken(), r.RequestURI)
 		}
@@ -83,39 +204,69 @@ func MakeHandlerPage(f RequestHandler) http.HandlerFunc {
 
 /*
 MakeHandlerAPI executes f.  A non nil bytes.Buffer is only
-passed to f for GET requests. For GET request the response in
-b is written to the client with gzipping.
+passed to f for GET and HEAD requests. For GET request the response in
+b is written to the client with gzipping.  HEAD requests get the same
+headers without the body.
 
 When res.Code is not http.StatusOK the contents of res.Msg are written to w.
 
 Surrogate-Control headers are also set for intermediate caches.
+
+If f panics the panic is logged with a stack trace and http.StatusInternalServerError
+is written to the client.
 */
 func MakeHandlerAPI(f RequestHandler) http.HandlerFunc {
+	return makeHandlerAPI(f, func() time.Duration { return DefaultTimeout })
+}
+
+/*
+MakeHandlerTimeout is MakeHandlerAPI with a deadline of d for f in place of DefaultTimeout
+e.g., to bound a handler that makes slow database queries.  r is passed to f with a context
+that is cancelled after d.  If the deadline is exceeded before f returns
+http.StatusServiceUnavailable is written to the client.  Zero disables the deadline.
+
+f is not stopped when the deadline is exceeded.  It must honor the context from r.Context()
+e.g., by passing it to database/sql QueryContext, to be interrupted.
+*/
+func MakeHandlerTimeout(f RequestHandler, d time.Duration) http.HandlerFunc {
+	return makeHandlerAPI(f, func() time.Duration { return d })
+}
+
+// makeHandlerAPI returns the handler for MakeHandlerAPI using the deadline from timeout.
+func makeHandlerAPI(f RequestHandler, timeout func() time.Duration) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		t := mtrapp.Start()
+		start := time.Now()
 		var res *Result
 
+		r, id := withRequestID(r)
+		w.Header().Set("X-Request-Id", id)
+
+		r, cancel := withTimeout(r, timeout())
+		defer cancel()
+
 		switch r.Method {
-		case "GET":
+		case "GET", "HEAD":
 			b := bufferPool.Get().(*bytes.Buffer)
 			defer bufferPool.Put(b)
 			b.Reset()
 
-			res = f(r, w.Header(), b)
+			res = timedOut(r, call(f, r, w.Header(), b))
 			t.Stop()
 			WriteBytes(w, r, res, b, false)
 		default:
-			res = f(r, w.Header(), nil)
+			res = timedOut(r, call(f, r, w.Header(), nil))
 			t.Stop()
 			Write(w, r, res)
 		}
 
+		observe(r, res, start)
 		t.Track(name(f) + "." + r.Method)
 		res.Count()
 
 		// log errors and slow 200s
-		if res.Code != http.StatusOK {
-			log.Printf("status: %d serving %s", res.Code, r.RequestURI)
+		if !success(res.Code) && res.Code != http.StatusNotModified {
+			logStatus(r, res)
 		} else if t.Taken() > 250 {
 			log.Printf("slow: took %d ms serving %s", t.Taken(), r.RequestURI)
 		}
@@ -124,15 +275,52 @@ func MakeHandlerAPI(f RequestHandler) http.HandlerFunc {
 
 /*
 WriteBytes writes the contents of b to w.  Appropriate response headers are set.
-The response is gzipped if appropriate for the client and the content.
+The response is compressed if appropriate for the client and the content.  Brotli (br)
+is preferred, then gzip, then deflate (zlib format) for clients that don't accept gzip.
 Surrogate-Control headers are also set for intermediate caches.
-Surrogate-Control set calling WriteBytes will be respected for res.Code == http.StatusOK
+Surrogate-Control set calling WriteBytes will be respected for 2xx res.Code
 and overwritten for other Codes.
 
-In the case of res.Code being for an error then HTML error pages or res.Msg is written
-to w depending on errorPage.
-
-If b is nil then only headers are written to w.
+A res.Code of http.StatusNotModified e.g., from CheckNotModified is written with
+headers and no body.
+
+In the case of res.Code not being 2xx or 304 then HTML error pages or res.Msg is written
+to w depending on errorPage.  Any Content-Encoding, Content-Length, or ETag set on w for
+the handler's body is removed.  Error pages are served with a Content-Security-Policy
+using the nonce from Nonce(r) or a new nonce.  For 5xx res.Code the ID from RequestID(r),
+if any, is included in the page or message.  Other HTML responses for requests with a nonce
+get the Content-Security-Policy from PageCSP unless it is already set on w.
+
+A handler can choose the error mode by setting the Weft-Error header to page, msg, or json
+in place of errorPage.  In json mode a JSON object is written with Content-Type application/json
+e.g., {"error":{"code":404,"message":"not found"}}.  The message is res.Msg or, if it is
+empty, the status text for res.Code.  The Weft-Error header is not sent to the client.
+
+If b is nil then only headers are written to w.  Content-Length is set when b is not compressed.  Nothing is written for StatusClientClosedRequest
+when the context of r is done as the client has gone away.  Otherwise it is written as an error
+that is not stored by caches.
+HopByHopHeaders set on w are removed.
+
+If res.Data is not nil, res.Code is 2xx, and b is empty, res.Data is encoded as JSON into b.
+If it can't be encoded InternalServerError is written and logged.
+
+For HEAD requests the status code and headers, including Content-Length and Content-Encoding,
+are the same as for a GET request with the same b but no body is written.
+
+For GET and HEAD requests with http.StatusOK and a non empty b a strong ETag is set from
+a hash of b, before any compression, unless the ETag header is already set on w.
+For GET and HEAD requests with an If-None-Match header that matches the ETag
+header, or with an If-Modified-Since header that is not before res.Modified,
+http.StatusNotModified is written with no body.  When the response
+is compressed the Content-Encoding is appended to the ETag e.g., "abc-gzip" so that
+caches can tell the variants apart.  Either variant matches If-None-Match.
+
+For GET requests with a Range header that can not be satisfied by b
+http.StatusRequestedRangeNotSatisfiable is written with a Content-Range header
+giving the size of b.  The response depends on the Range header so it is not stored
+by caches and Range is added to Vary.  The ETag, Last-Modified, Surrogate-Key, and Age
+headers for b are not sent with it.  Satisfiable ranges are ignored and all of b is
+written with the same caching headers as a request without a Range header.
 */
 func WriteBytes(w http.ResponseWriter, r *http.Request, res *Result, b *bytes.Buffer, errorPage bool) {
 	if res.Code == 0 {
@@ -140,27 +328,67 @@ func WriteBytes(w http.ResponseWriter, r *http.Request, res *Result, b *bytes.Bu
 		log.Printf("WARN: weft - received Result.Code == 0, serving 200.")
 	}
 
+	// the client has gone away.
+	if res.Code == StatusClientClosedRequest && r.Context().Err() != nil {
+		return
+	}
+
+	stripHopByHop(w.Header())
+
+	mode := errorMode(w.Header())
+	if mode == "" && errorPage {
+		mode = "page"
+	}
+
+	if r.Method == "HEAD" {
+		w = headWriter{w}
+	}
+
+	if res.Data != nil && success(res.Code) && b != nil && b.Len() == 0 {
+		if err := encodeData(w.Header(), b, res.Data); err != nil {
+			res = InternalServerError(err)
+			logStatus(r, res)
+		}
+	}
+
 	if w.Header().Get("Surrogate-Control") == "" {
 		w.Header().Set("Surrogate-Control", "max-age=10")
 	}
 
-	if res.Code != 200 {
-		switch errorPage {
-		case true:
+	if res.Code == http.StatusNotModified {
+		setHeaders(w.Header(), res)
+		AddVary(w.Header(), "Accept-Encoding")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	if !success(res.Code) {
+		clearBodyHeaders(w.Header())
+
+		switch mode {
+		case "json":
+			w.Header().Set("Content-Type", "application/json")
+			if b != nil {
+				b.Reset()
+				b.Write(errorJSON(r, res))
+			}
+		case "page":
+			n := Nonce(r)
+			if n == "" {
+				n = newNonce()
+			}
+
 			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Header().Set("Content-Security-Policy", errorCSP(n))
 			if b != nil {
 				b.Reset()
-				if e, ok := errorPages[res.Code]; ok {
-					b.Write(e)
-				} else {
-					b.Write(errorPages[http.StatusInternalServerError])
-				}
+				b.Write(renderErrorPage(res.Code, n, serverErrorID(r, res)))
 			}
-		case false:
+		default:
 			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 			if b != nil {
 				b.Reset()
-				b.WriteString(res.Msg)
+				b.WriteString(errorMsg(r, res))
 			}
 		}
 
@@ -171,36 +399,103 @@ func WriteBytes(w http.ResponseWriter, r *http.Request, res *Result, b *bytes.Bu
 		}
 	}
 
+	setHeaders(w.Header(), res)
+
 	/*
 	 write the response.  With gzipping if possible.
 	*/
 
-	w.Header().Add("Vary", "Accept-Encoding")
+	AddVary(w.Header(), "Accept-Encoding")
 
 	if w.Header().Get("Content-Type") == "" && b != nil {
 		w.Header().Set("Content-Type", http.DetectContentType(b.Bytes()))
 	}
 
-	if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") && b != nil && b.Len() > 20 {
+	// pages from MakeHandlerPage have a nonce.
+	if n := Nonce(r); n != "" && PageCSP != "" && mediaType(w.Header()) == "text/html" &&
+		w.Header().Get("Content-Security-Policy") == "" {
+		w.Header().Set("Content-Security-Policy", csp(n))
+	}
+
+	if PostProcess != nil && b != nil {
+		p := PostProcess(w.Header().Get("Content-Type"), b.Bytes())
+		b.Reset()
+		b.Write(p)
+	}
+
+	if res.Code == http.StatusOK && b != nil && b.Len() > 0 && (r.Method == "GET" || r.Method == "HEAD") &&
+		w.Header().Get("ETag") == "" {
+		w.Header().Set("ETag", etag(b.Bytes()))
+	}
 
-		contentType := w.Header().Get("Content-Type")
+	enc := contentEncoding(r, w.Header(), b)
 
-		i := strings.Index(contentType, ";")
-		if i > 0 {
-			contentType = contentType[0:i]
+	if res.Code == http.StatusOK && notModified(r, w.Header(), res.Modified) {
+		// the ETag must be the same as for the variant that would have been sent.
+		if e := w.Header().Get("ETag"); e != "" && enc != "" {
+			w.Header().Set("ETag", etagSuffix(e, enc))
 		}
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
 
-		contentType = strings.TrimSpace(contentType)
+	if res.Code == http.StatusOK && b != nil && unsatisfiableRange(r, b.Len()) {
+		w.Header().Set("Content-Range", "bytes */"+strconv.Itoa(b.Len()))
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Surrogate-Control", surrogateControl[http.StatusRequestedRangeNotSatisfiable])
+		// the validators and cache headers are for the full representation, not the 416.
+		clearBodyHeaders(w.Header())
+		for _, k := range []string{"Last-Modified", "Surrogate-Key", "Age"} {
+			w.Header().Del(k)
+		}
+		AddVary(w.Header(), "Range")
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		w.Write([]byte("range not satisfiable"))
+		return
+	}
 
-		if compressibleMimes[contentType] {
-			w.Header().Set("Content-Encoding", "gzip")
-			gz := gzip.NewWriter(w)
-			defer gz.Close()
+	if enc != "" {
+		w.Header().Set("Content-Encoding", enc)
+		if e := w.Header().Get("ETag"); e != "" {
+			w.Header().Set("ETag", etagSuffix(e, enc))
+		}
+
+		if c, ok := compressors[mediaType(w.Header())]; ok && c.encoding == enc {
+			cw := c.factory(w)
+			defer cw.Close()
 			w.WriteHeader(res.Code)
-			b.WriteTo(gz)
+			writeFlush(w, cw, b)
 
 			return
 		}
+
+		switch enc {
+		case "br":
+			br := brotli.NewWriter(w)
+			defer br.Close()
+			w.WriteHeader(res.Code)
+			writeFlush(w, br, b)
+		case "gzip":
+			gz := newGzipWriter(w)
+			defer gz.Close()
+			w.WriteHeader(res.Code)
+			writeFlush(w, gz, b)
+		case "deflate":
+			// deflate in HTTP is the zlib format (RFC 9110 8.4.1.2), not raw deflate.
+			zw, err := zlib.NewWriterLevel(w, CompressionLevel)
+			if err != nil {
+				zw = zlib.NewWriter(w)
+			}
+			defer zw.Close()
+			w.WriteHeader(res.Code)
+			writeFlush(w, zw, b)
+		}
+
+		return
+	}
+
+	if b != nil {
+		w.Header().Set("Content-Length", strconv.Itoa(b.Len()))
 	}
 
 	w.WriteHeader(res.Code)
@@ -211,11 +506,22 @@ func WriteBytes(w http.ResponseWriter, r *http.Request, res *Result, b *bytes.Bu
 
 /*
 Write writes a header response to the client and in the case of
-res.Code != http.StatusOK also writes res.Msg.
+res.Code not being 2xx also writes res.Msg.
+For 5xx res.Code the ID from RequestID(r), if any, is appended to res.Msg.
+When the Weft-Error header is set to json the error is written as JSON as for WriteBytes.
+Any Content-Encoding, Content-Length, or ETag set on w is removed for errors.
+For 2xx res.Code res.Data, if not nil, is encoded as JSON and written as for WriteBytes.
 
 Surrogate-Control headers are also set for intermediate caches.
 Surrogate-Control set calling Write will be respected for
-res.Code == http.StatusOK and overwritten for other Codes.
+2xx res.Code and overwritten for other Codes.
+
+StatusClientClosedRequest is handled as for WriteBytes.  HopByHopHeaders set on w are removed.
+For HEAD requests the status code and headers are written without res.Msg.
+
+For GET and HEAD requests with an If-None-Match header that matches the ETag
+header set on w, an If-Modified-Since header that is not before res.Modified,
+or a res.Code of http.StatusNotModified, http.StatusNotModified is written.
 */
 func Write(w http.ResponseWriter, r *http.Request, res *Result) {
 	if res.Code == 0 {
@@ -223,21 +529,345 @@ func Write(w http.ResponseWriter, r *http.Request, res *Result) {
 		log.Printf("WARN: weft - received Result.Code == 0, serving 200.")
 	}
 
-	switch res.Code {
-	case http.StatusOK:
+	// the client has gone away.
+	if res.Code == StatusClientClosedRequest && r.Context().Err() != nil {
+		return
+	}
+
+	stripHopByHop(w.Header())
+
+	mode := errorMode(w.Header())
+
+	if r.Method == "HEAD" {
+		w = headWriter{w}
+	}
+
+	var data bytes.Buffer
+
+	if res.Data != nil && success(res.Code) {
+		if err := encodeData(w.Header(), &data, res.Data); err != nil {
+			res = InternalServerError(err)
+			logStatus(r, res)
+		}
+	}
+
+	switch {
+	case success(res.Code), res.Code == http.StatusNotModified:
 		if w.Header().Get("Surrogate-Control") == "" {
 			w.Header().Set("Surrogate-Control", "max-age=10")
 		}
 
+		setHeaders(w.Header(), res)
+
+		if res.Code == http.StatusNotModified || (res.Code == http.StatusOK && notModified(r, w.Header(), res.Modified)) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		if data.Len() > 0 {
+			w.Header().Set("Content-Length", strconv.Itoa(data.Len()))
+		}
+
 		w.WriteHeader(res.Code)
+		data.WriteTo(w)
 	default:
+		clearBodyHeaders(w.Header())
+
 		if s, ok := surrogateControl[res.Code]; ok {
 			w.Header().Set("Surrogate-Control", s)
 		} else {
 			w.Header().Set("Surrogate-Control", "max-age=10")
 		}
 
+		setHeaders(w.Header(), res)
+
+		if mode == "json" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(res.Code)
+			w.Write(errorJSON(r, res))
+			return
+		}
+
 		w.WriteHeader(res.Code)
-		w.Write([]byte(res.Msg))
+		w.Write([]byte(errorMsg(r, res)))
+	}
+}
+
+// observe calls the metrics callback, if any, with the time since start.
+func observe(r *http.Request, res *Result, start time.Time) {
+	if metricsCallback != nil {
+		metricsCallback(r.URL.Path, res.Code, time.Since(start))
+	}
+}
+
+// headWriter discards the response body for HEAD requests.
+type headWriter struct {
+	http.ResponseWriter
+}
+
+func (headWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+// stripHopByHop removes HopByHopHeaders and the headers named in the Connection header from h.
+// Connection: close is kept.
+func stripHopByHop(h http.Header) {
+	var closeConn bool
+
+	for _, c := range h["Connection"] {
+		for _, k := range strings.Split(c, ",") {
+			k = strings.TrimSpace(k)
+			switch {
+			case strings.EqualFold(k, "close"):
+				closeConn = true
+			case k != "":
+				h.Del(k)
+			}
+		}
+	}
+
+	for _, k := range HopByHopHeaders {
+		h.Del(k)
+	}
+
+	if closeConn {
+		h.Set("Connection", "close")
+	}
+}
+
+// clearBodyHeaders removes the headers a handler set to describe its body from h.  It is used
+// when the body is replaced e.g., with an error message, which is then compressed as usual.
+func clearBodyHeaders(h http.Header) {
+	h.Del("Content-Encoding")
+	h.Del("Content-Length")
+	h.Del("ETag")
+}
+
+// serverErrorID returns the request ID for r if res is a 5xx error, otherwise an empty string.
+func serverErrorID(r *http.Request, res *Result) string {
+	if res.Code < http.StatusInternalServerError || res.Code > 599 {
+		return ""
+	}
+
+	return RequestID(r)
+}
+
+// encodeData encodes data as JSON into b and sets the Content-Type in h if it is not set.
+func encodeData(h http.Header, b *bytes.Buffer, data interface{}) error {
+	d, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	b.Write(d)
+
+	if h.Get("Content-Type") == "" {
+		h.Set("Content-Type", "application/json")
+	}
+
+	return nil
+}
+
+// mediaType returns the Content-Type in h without parameters e.g., text/html.
+func mediaType(h http.Header) string {
+	t := h.Get("Content-Type")
+
+	if i := strings.Index(t, ";"); i > 0 {
+		t = t[0:i]
+	}
+
+	return strings.TrimSpace(t)
+}
+
+/*
+contentEncoding returns the Content-Encoding that WriteBytes uses to compress b for r, or an
+empty string if b is not compressed.  A compressor registered for the Content-Type in h is
+preferred, then br, gzip, and deflate for compressible types.  b is not compressed when it
+is shorter than MinCompressLength or when the handler has set the Content-Encoding in h.
+*/
+func contentEncoding(r *http.Request, h http.Header, b *bytes.Buffer) string {
+	if h.Get("Content-Encoding") != "" || b == nil || b.Len() < MinCompressLength {
+		return ""
+	}
+
+	t := mediaType(h)
+
+	if c, ok := compressors[t]; ok && acceptsEncoding(r, c.encoding) {
+		return c.encoding
+	}
+
+	if !compressibleMimes[t] {
+		return ""
+	}
+
+	for _, e := range []string{"br", "gzip", "deflate"} {
+		if acceptsEncoding(r, e) {
+			return e
+		}
+	}
+
+	return ""
+}
+
+// errorMode returns the error mode set by a handler in the Weft-Error header of h, if any,
+// and removes the header so that it is not sent to the client.
+func errorMode(h http.Header) string {
+	m := strings.ToLower(strings.TrimSpace(h.Get("Weft-Error")))
+	h.Del("Weft-Error")
+
+	switch m {
+	case "page", "msg", "json":
+		return m
+	}
+
+	return ""
+}
+
+// errorMsg returns res.Msg with the request ID for r appended for 5xx errors.
+func errorMsg(r *http.Request, res *Result) string {
+	if id := serverErrorID(r, res); id != "" {
+		return res.Msg + " (request id: " + id + ")"
+	}
+
+	return res.Msg
+}
+
+// withTimeout returns r with a context that is cancelled after d.  If d is zero r is returned unchanged.
+func withTimeout(r *http.Request, d time.Duration) (*http.Request, context.CancelFunc) {
+	if d <= 0 {
+		return r, func() {}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), d)
+
+	return r.WithContext(ctx), cancel
+}
+
+// timedOut returns ServiceUnavailableError if the deadline for r has been exceeded, otherwise res.
+func timedOut(r *http.Request, res *Result) *Result {
+	if err := r.Context().Err(); err == context.DeadlineExceeded {
+		return ServiceUnavailableError(err)
+	}
+
+	return res
+}
+
+// errPanic is the message sent to the client when a handler panics.  The panic value is only logged.
+var errPanic = errors.New("internal server error")
+
+// call returns the result of f.  If f panics the panic is logged with a stack trace, the
+// headers f set for its body are removed from h, and InternalServerError is returned.
+// Panics with http.ErrAbortHandler are not recovered.
+func call(f RequestHandler, r *http.Request, h http.Header, b *bytes.Buffer) (res *Result) {
+	defer func() {
+		if p := recover(); p != nil {
+			// http.ErrAbortHandler is how a handler aborts the response.  Let net/http handle it.
+			if p == http.ErrAbortHandler {
+				panic(p)
+			}
+
+			log.Printf("ERROR: weft - panic serving %s: %v\n%s", r.RequestURI, p, debug.Stack())
+			clearBodyHeaders(h)
+			res = InternalServerError(errPanic)
+		}
+	}()
+
+	return f(r, h, b)
+}
+
+// setHeaders sets response headers for the optional fields in res.
+func setHeaders(h http.Header, res *Result) {
+	if len(res.SurrogateKeys) > 0 {
+		h.Set("Surrogate-Key", strings.Join(res.SurrogateKeys, " "))
+	}
+
+	if res.Location != "" {
+		h.Set("Location", res.Location)
+	}
+
+	if res.Age > 0 {
+		h.Set("Age", strconv.FormatInt(int64(res.Age/time.Second), 10))
+	}
+
+	if res.BlockedBy != "" {
+		h.Add("Link", "<"+res.BlockedBy+`>; rel="blocked-by"`)
+	}
+
+	if !res.Modified.IsZero() {
+		h.Set("Last-Modified", res.Modified.UTC().Format(http.TimeFormat))
+	}
+
+	if res.RetryAfter > 0 {
+		h.Set("Retry-After", strconv.FormatInt(int64((res.RetryAfter+time.Second-1)/time.Second), 10))
+	}
+
+	// stale-while-revalidate only has meaning with a freshness lifetime from max-age.
+	if res.StaleWhileRevalidate > 0 && success(res.Code) {
+		swr := "stale-while-revalidate=" + strconv.FormatInt(int64(res.StaleWhileRevalidate/time.Second), 10)
+
+		s := h.Get("Surrogate-Control")
+		if maxAge(s) == "" {
+			return
+		}
+
+		h.Set("Surrogate-Control", s+", "+swr)
+
+		switch c := h.Get("Cache-Control"); {
+		case c == "":
+			h.Set("Cache-Control", maxAge(s)+", "+swr)
+		case maxAge(c) != "":
+			h.Set("Cache-Control", c+", "+swr)
+		}
+	}
+}
+
+// maxAge returns the max-age directive e.g., max-age=10 from the cache control header value v
+// or an empty string if there is none.
+func maxAge(v string) string {
+	for _, d := range strings.Split(v, ",") {
+		d = strings.TrimSpace(d)
+		if strings.HasPrefix(strings.ToLower(d), "max-age=") {
+			return d
+		}
+	}
+
+	return ""
+}
+
+// newGzipWriter returns a gzip.Writer for w using CompressionLevel or the default level if it is invalid.
+func newGzipWriter(w io.Writer) *gzip.Writer {
+	gz, err := gzip.NewWriterLevel(w, CompressionLevel)
+	if err != nil {
+		return gzip.NewWriter(w)
+	}
+
+	return gz
+}
+
+// compressFlusher is a compressing writer that can flush buffered data e.g., gzip.Writer.
+type compressFlusher interface {
+	Flush() error
+}
+
+// writeFlush writes b to cw.  If CompressFlushSize > 0 and cw is a compressFlusher then cw
+// and w are flushed every CompressFlushSize bytes.
+func writeFlush(w http.ResponseWriter, cw io.Writer, b *bytes.Buffer) {
+	c, ok := cw.(compressFlusher)
+	if CompressFlushSize <= 0 || !ok {
+		b.WriteTo(cw)
+		return
+	}
+
+	f, _ := w.(http.Flusher)
+
+	for b.Len() > 0 {
+		cw.Write(b.Next(CompressFlushSize))
+
+		if b.Len() > 0 {
+			c.Flush()
+			if f != nil {
+				f.Flush()
+			}
+		}
 	}
 }
@@ -3,11 +3,17 @@ package weft
 import (
 	"bytes"
 	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"github.com/andybalholm/brotli"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"runtime"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 /*
@@ -39,7 +45,7 @@ func TestWriteGzip(t *testing.T) {
 	WriteBytes(w, r, &res, &b, false)
 	checkResponse(t, w, res.Code, "max-age=10", "", "")
 
-	// gzip request with length buffer < 20 does not get compressed.
+	// gzip request with length buffer < MinCompressLength does not get compressed.
 	b.Reset()
 	b.WriteString("bogan impsum")
 	e := b.String()
@@ -50,7 +56,7 @@ func TestWriteGzip(t *testing.T) {
 	WriteBytes(w, r, &res, &b, false)
 	checkResponse(t, w, res.Code, "max-age=10", "", e)
 
-	// gzip request with length buffer > 20 gets compressed.
+	// gzip request with length buffer > MinCompressLength gets compressed.
 	b.Reset()
 	b.WriteString("bogan impsum bogan impsum")
 	b.WriteString("bogan impsum bogan impsum")
@@ -109,6 +115,495 @@ func TestWriteGzip(t *testing.T) {
 	}
 }
 
+func TestWriteContentLength(t *testing.T) {
+	e := strings.Repeat("bogan impsum ", 10)
+
+	in := []struct {
+		accept        string
+		contentLength string
+		encoding      string
+	}{
+		{"", strconv.Itoa(len(e)), ""},
+		{"gzip", "", "gzip"},
+	}
+
+	for _, v := range in {
+		r := httptest.NewRequest("GET", "http://test.com", nil)
+		r.Header.Set("Accept-Encoding", v.accept)
+
+		var b bytes.Buffer
+		b.WriteString(e)
+
+		w := httptest.NewRecorder()
+		w.Header().Set("Content-Type", "text/plain")
+		WriteBytes(w, r, &Result{Ok: true, Code: http.StatusOK}, &b, false)
+		checkResponse(t, w, http.StatusOK, "max-age=10", v.encoding, e)
+
+		if _, ok := w.Header()["Content-Length"]; ok != (v.contentLength != "") || w.Header().Get("Content-Length") != v.contentLength {
+			t.Errorf("Accept-Encoding: %s expected Content-Length %q got %q", v.accept, v.contentLength, w.Header().Get("Content-Length"))
+		}
+	}
+}
+
+// TestWriteGzipThreshold pins the compression boundary at MinCompressLength bytes.
+func TestWriteGzipThreshold(t *testing.T) {
+	in := []struct {
+		length   int
+		encoding string
+	}{
+		{MinCompressLength - 1, ""},
+		{MinCompressLength, "gzip"},
+		{MinCompressLength + 1, "gzip"},
+	}
+
+	for _, v := range in {
+		r := httptest.NewRequest("GET", "http://test.com", nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+
+		var b bytes.Buffer
+		b.WriteString(strings.Repeat("a", v.length))
+		e := b.String()
+
+		w := httptest.NewRecorder()
+		w.Header().Set("Content-Type", "text/plain")
+		WriteBytes(w, r, &Result{Ok: true, Code: http.StatusOK}, &b, false)
+		checkResponse(t, w, http.StatusOK, "max-age=10", v.encoding, e)
+	}
+}
+
+func TestWriteBrotli(t *testing.T) {
+	e := strings.Repeat("bogan impsum ", 10)
+
+	in := []struct {
+		accept      string
+		contentType string
+		body        string
+		encoding    string
+	}{
+		{"br", "application/json", e, "br"},
+		{"gzip, deflate, br", "application/json", e, "br"},
+		{"gzip, br;q=0", "application/json", e, "gzip"},
+		{"gzip", "application/json", e, "gzip"},
+		{"br", "image/png", e, ""},
+		{"br", "application/json", "bogan impsum", ""},
+	}
+
+	for _, v := range in {
+		r := httptest.NewRequest("GET", "http://test.com", nil)
+		r.Header.Set("Accept-Encoding", v.accept)
+
+		var b bytes.Buffer
+		b.WriteString(v.body)
+
+		w := httptest.NewRecorder()
+		w.Header().Set("Content-Type", v.contentType)
+		WriteBytes(w, r, &Result{Ok: true, Code: http.StatusOK}, &b, false)
+		checkResponse(t, w, http.StatusOK, "max-age=10", v.encoding, v.body)
+
+		if w.Header().Get("Vary") != "Accept-Encoding" {
+			t.Errorf("%s expected Vary: Accept-Encoding got %s", v.accept, w.Header().Get("Vary"))
+		}
+	}
+}
+
+func TestWriteDeflate(t *testing.T) {
+	e := strings.Repeat("bogan impsum ", 10)
+
+	in := []struct {
+		accept      string
+		contentType string
+		body        string
+		encoding    string
+	}{
+		{"deflate", "text/plain", e, "deflate"},
+		{"deflate, gzip", "text/plain", e, "gzip"},
+		{"gzip;q=0, deflate", "text/plain", e, "deflate"},
+		{"deflate", "image/png", e, ""},
+		{"deflate", "text/plain", "bogan impsum", ""},
+	}
+
+	for _, v := range in {
+		r := httptest.NewRequest("GET", "http://test.com", nil)
+		r.Header.Set("Accept-Encoding", v.accept)
+
+		var b bytes.Buffer
+		b.WriteString(v.body)
+
+		w := httptest.NewRecorder()
+		w.Header().Set("Content-Type", v.contentType)
+		WriteBytes(w, r, &Result{Ok: true, Code: http.StatusOK}, &b, false)
+		checkResponse(t, w, http.StatusOK, "max-age=10", v.encoding, v.body)
+	}
+}
+
+func TestCompressionLevel(t *testing.T) {
+	defer func() { CompressionLevel = gzip.DefaultCompression }()
+
+	e := strings.Repeat("bogan impsum ", 10)
+
+	// the gzip header XFL byte records best compression (2) and fastest (4).
+	in := []struct {
+		level int
+		xfl   byte
+	}{
+		{gzip.DefaultCompression, 0},
+		{gzip.BestSpeed, 4},
+		{gzip.BestCompression, 2},
+		{42, 0},
+		{-3, 0},
+	}
+
+	for _, v := range in {
+		CompressionLevel = v.level
+
+		r := httptest.NewRequest("GET", "http://test.com", nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+
+		var b bytes.Buffer
+		b.WriteString(e)
+
+		w := httptest.NewRecorder()
+		w.Header().Set("Content-Type", "text/plain")
+		WriteBytes(w, r, &Result{Ok: true, Code: http.StatusOK}, &b, false)
+
+		if w.Body.Len() < 10 {
+			t.Fatalf("level %d short gzip body", v.level)
+		}
+
+		if x := w.Body.Bytes()[8]; x != v.xfl {
+			t.Errorf("level %d expected XFL %d got %d", v.level, v.xfl, x)
+		}
+
+		checkResponse(t, w, http.StatusOK, "max-age=10", "gzip", e)
+
+		// deflate uses the same levels.
+		r.Header.Set("Accept-Encoding", "deflate")
+		b.WriteString(e)
+
+		w = httptest.NewRecorder()
+		w.Header().Set("Content-Type", "text/plain")
+		WriteBytes(w, r, &Result{Ok: true, Code: http.StatusOK}, &b, false)
+		checkResponse(t, w, http.StatusOK, "max-age=10", "deflate", e)
+	}
+}
+
+func TestMinCompressLength(t *testing.T) {
+	defer func() { MinCompressLength = 20 }()
+	MinCompressLength = 5
+
+	r := httptest.NewRequest("GET", "http://test.com", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+
+	var b bytes.Buffer
+	b.WriteString(`{"mag":4.2}`)
+	b.WriteString(" ")
+
+	if b.Len() != 12 {
+		t.Fatalf("expected 12 byte body got %d", b.Len())
+	}
+
+	w := httptest.NewRecorder()
+	w.Header().Set("Content-Type", "application/json")
+	WriteBytes(w, r, &Result{Ok: true, Code: http.StatusOK}, &b, false)
+	checkResponse(t, w, http.StatusOK, "max-age=10", "gzip", `{"mag":4.2} `)
+
+	b.WriteString("1234")
+
+	w = httptest.NewRecorder()
+	w.Header().Set("Content-Type", "application/json")
+	WriteBytes(w, r, &Result{Ok: true, Code: http.StatusOK}, &b, false)
+	checkResponse(t, w, http.StatusOK, "max-age=10", "", "1234")
+}
+
+// flushRecorder records the length of the body written at each Flush.
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	flushed []int
+}
+
+func (f *flushRecorder) Flush() {
+	f.flushed = append(f.flushed, f.Body.Len())
+	f.ResponseRecorder.Flush()
+}
+
+/*
+TestWriteFlush checks that large compressed responses are flushed
+to the client at CompressFlushSize intervals.
+*/
+func TestWriteFlush(t *testing.T) {
+	defer func() { CompressFlushSize = 0 }()
+
+	var e string
+	for i := 0; i < 100; i++ {
+		e += "bogan impsum bogan impsum"
+	}
+
+	res := Result{Code: http.StatusOK}
+
+	for _, enc := range []string{"gzip", "br", "deflate"} {
+		r, err := http.NewRequest("GET", "http://test.com", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Accept-Encoding", enc)
+
+		var b bytes.Buffer
+		b.WriteString(e)
+
+		CompressFlushSize = 1000
+		w := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+		w.Header().Set("Content-Type", "text/plain")
+		WriteBytes(w, r, &res, &b, false)
+		checkResponse(t, w.ResponseRecorder, res.Code, "max-age=10", enc, e)
+
+		// 2500 bytes written in 1000 byte chunks is flushed twice before the last chunk.
+		if len(w.flushed) != 2 {
+			t.Fatalf("%s expected 2 flushes got %d", enc, len(w.flushed))
+		}
+
+		if w.flushed[0] == 0 {
+			t.Errorf("%s expected data to be written before the first flush", enc)
+		}
+
+		if w.flushed[1] <= w.flushed[0] {
+			t.Errorf("%s expected more data to be written before the second flush", enc)
+		}
+
+		// flushing is disabled by default.
+		CompressFlushSize = 0
+		b.Reset()
+		b.WriteString(e)
+		w = &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+		w.Header().Set("Content-Type", "text/plain")
+		WriteBytes(w, r, &res, &b, false)
+		checkResponse(t, w.ResponseRecorder, res.Code, "max-age=10", enc, e)
+
+		if len(w.flushed) != 0 {
+			t.Errorf("%s expected no flushes got %d", enc, len(w.flushed))
+		}
+	}
+}
+
+// TestWriteContentEncoding checks content already encoded by the handler is not compressed again.
+func TestWriteContentEncoding(t *testing.T) {
+	r, err := http.NewRequest("GET", "http://test.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Accept-Encoding", "gzip")
+
+	var c bytes.Buffer
+	gz := gzip.NewWriter(&c)
+	gz.Write([]byte("bogan impsum bogan impsum bogan impsum bogan impsum"))
+	gz.Close()
+
+	var b bytes.Buffer
+	b.Write(c.Bytes())
+
+	res := Result{Code: http.StatusOK}
+
+	w := httptest.NewRecorder()
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Content-Encoding", "gzip")
+	WriteBytes(w, r, &res, &b, false)
+	checkResponse(t, w, res.Code, "max-age=10", "gzip", "bogan impsum bogan impsum bogan impsum bogan impsum")
+}
+
+func TestErrorContentEncoding(t *testing.T) {
+	notFound := func(r *http.Request, h http.Header, b *bytes.Buffer) *Result {
+		h.Set("Content-Encoding", "gzip")
+		h.Set("Content-Length", "1234")
+		h.Set("ETag", `"abc"`)
+		return &NotFound
+	}
+
+	panics := func(r *http.Request, h http.Header, b *bytes.Buffer) *Result {
+		h.Set("Content-Encoding", "gzip")
+		h.Set("Content-Length", "1234")
+		h.Set("ETag", `"abc"`)
+		panic("compressed body failed")
+	}
+
+	in := []struct {
+		id             string
+		handler        http.HandlerFunc
+		method         string
+		acceptEncoding string
+		code           int
+		encoding       string
+		body           string
+	}{
+		{"error", MakeHandlerAPI(notFound), "GET", "", http.StatusNotFound, "", "not found"},
+		{"error gzip", MakeHandlerAPI(notFound), "GET", "gzip", http.StatusNotFound, "", "not found"},
+		{"error post", MakeHandlerAPI(notFound), "POST", "gzip", http.StatusNotFound, "", "not found"},
+		{"panic", MakeHandlerAPI(panics), "GET", "", http.StatusInternalServerError, "", "internal server error"},
+		{"panic page", MakeHandlerPage(panics), "GET", "", http.StatusInternalServerError, "", "<html"},
+		{"panic page br", MakeHandlerPage(panics), "GET", "br", http.StatusInternalServerError, "br", "<html"},
+	}
+
+	for _, v := range in {
+		r := httptest.NewRequest(v.method, "http://test.com", nil)
+		if v.acceptEncoding != "" {
+			r.Header.Set("Accept-Encoding", v.acceptEncoding)
+		}
+
+		w := httptest.NewRecorder()
+		v.handler.ServeHTTP(w, r)
+
+		if w.Code != v.code {
+			t.Errorf("%s expected status %d got %d", v.id, v.code, w.Code)
+		}
+
+		if e := w.Header().Get("Content-Encoding"); e != v.encoding {
+			t.Errorf("%s expected Content-Encoding %q got %q", v.id, v.encoding, e)
+		}
+
+		if e := w.Header().Get("ETag"); e != "" {
+			t.Errorf("%s expected no ETag got %s", v.id, e)
+		}
+
+		if l := w.Header().Get("Content-Length"); l == "1234" {
+			t.Errorf("%s got the handler's Content-Length", v.id)
+		}
+
+		var body bytes.Buffer
+		if v.encoding == "br" {
+			body.ReadFrom(brotli.NewReader(w.Body))
+		} else {
+			body.ReadFrom(w.Body)
+		}
+
+		if !strings.Contains(body.String(), v.body) {
+			t.Errorf("%s expected body containing %s got %s", v.id, v.body, body.String())
+		}
+	}
+}
+
+func TestWritePostProcess(t *testing.T) {
+	defer func() { PostProcess = nil }()
+
+	PostProcess = func(contentType string, body []byte) []byte {
+		if strings.HasPrefix(contentType, "text/html") {
+			return append(body, []byte("<footer>GeoNet</footer>")...)
+		}
+		return body
+	}
+
+	r, err := http.NewRequest("GET", "http://test.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := Result{Code: http.StatusOK}
+	var b bytes.Buffer
+
+	b.WriteString("<html>bogan impsum</html>")
+	w := httptest.NewRecorder()
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	WriteBytes(w, r, &res, &b, false)
+	checkResponse(t, w, res.Code, "max-age=10", "", "<html>bogan impsum</html><footer>GeoNet</footer>")
+
+	if w.Body.Len() != len("<html>bogan impsum</html><footer>GeoNet</footer>") {
+		t.Errorf("wrong body length %d", w.Body.Len())
+	}
+
+	// the transformed body is compressed.
+	r.Header.Set("Accept-Encoding", "gzip")
+	b.Reset()
+	b.WriteString("<html>bogan impsum</html>")
+	w = httptest.NewRecorder()
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	WriteBytes(w, r, &res, &b, false)
+	checkResponse(t, w, res.Code, "max-age=10", "gzip", "<html>bogan impsum</html><footer>GeoNet</footer>")
+
+	// other content types are unchanged.
+	b.Reset()
+	b.WriteString(`{"bogan": "impsum"}`)
+	w = httptest.NewRecorder()
+	w.Header().Set("Content-Type", "application/json")
+	WriteBytes(w, r, &res, &b, false)
+	checkResponse(t, w, res.Code, "max-age=10", "", `{"bogan": "impsum"}`)
+}
+
+func TestRegisterCompressor(t *testing.T) {
+	defer delete(compressors, "application/x-bogan")
+
+	RegisterCompressor("application/x-bogan", func(w io.Writer) io.WriteCloser {
+		f, _ := zlib.NewWriterLevel(w, zlib.BestCompression)
+		return f
+	}, "deflate")
+
+	r, err := http.NewRequest("GET", "http://test.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := "bogan impsum bogan impsum bogan impsum bogan impsum bogan impsum"
+	res := Result{Code: http.StatusOK}
+	var b bytes.Buffer
+
+	// the registered compressor is used when the client accepts its encoding.
+	r.Header.Set("Accept-Encoding", "gzip, deflate")
+	b.WriteString(e)
+	w := httptest.NewRecorder()
+	w.Header().Set("Content-Type", "application/x-bogan")
+	WriteBytes(w, r, &res, &b, false)
+	checkResponse(t, w, res.Code, "max-age=10", "deflate", e)
+
+	// otherwise the type is not compressed.
+	r.Header.Set("Accept-Encoding", "gzip")
+	b.Reset()
+	b.WriteString(e)
+	w = httptest.NewRecorder()
+	w.Header().Set("Content-Type", "application/x-bogan")
+	WriteBytes(w, r, &res, &b, false)
+	checkResponse(t, w, res.Code, "max-age=10", "", e)
+
+	// gzip is still used for other types.
+	r.Header.Set("Accept-Encoding", "gzip, deflate")
+	b.Reset()
+	b.WriteString(e)
+	w = httptest.NewRecorder()
+	w.Header().Set("Content-Type", "text/plain")
+	WriteBytes(w, r, &res, &b, false)
+	checkResponse(t, w, res.Code, "max-age=10", "gzip", e)
+
+	// gzip is not used when the client excludes it.
+	r.Header.Set("Accept-Encoding", "gzip;q=0, identity")
+	b.Reset()
+	b.WriteString(e)
+	w = httptest.NewRecorder()
+	w.Header().Set("Content-Type", "text/plain")
+	WriteBytes(w, r, &res, &b, false)
+	checkResponse(t, w, res.Code, "max-age=10", "", e)
+}
+
+func TestRegisterCompressibleMime(t *testing.T) {
+	e := strings.Repeat("bogan impsum ", 10)
+
+	write := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "http://test.com", nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+
+		var b bytes.Buffer
+		b.WriteString(e)
+
+		w := httptest.NewRecorder()
+		w.Header().Set("Content-Type", "application/vnd.fdsn.mseed")
+		WriteBytes(w, r, &Result{Ok: true, Code: http.StatusOK}, &b, false)
+
+		return w
+	}
+
+	checkResponse(t, write(), http.StatusOK, "max-age=10", "", e)
+
+	RegisterCompressibleMime("application/vnd.fdsn.mseed")
+	checkResponse(t, write(), http.StatusOK, "max-age=10", "gzip", e)
+
+	UnregisterCompressibleMime("application/vnd.fdsn.mseed")
+	checkResponse(t, write(), http.StatusOK, "max-age=10", "", e)
+}
+
 func TestWritePage(t *testing.T) {
 	var w *httptest.ResponseRecorder
 
@@ -140,32 +635,32 @@ func TestWritePage(t *testing.T) {
 	w = httptest.NewRecorder()
 	res.Code = http.StatusNotFound
 	WriteBytes(w, r, &res, &b, true)
-	checkResponse(t, w, res.Code, "max-age=10", "", err404)
+	checkResponse(t, w, res.Code, "max-age=10", "", pageNonce(w, err404))
 
 	w = httptest.NewRecorder()
 	res.Code = http.StatusInternalServerError
 	WriteBytes(w, r, &res, &b, true)
-	checkResponse(t, w, res.Code, "max-age=10", "", err503)
+	checkResponse(t, w, res.Code, "max-age=10", "", pageNonce(w, err503))
 
 	w = httptest.NewRecorder()
 	res.Code = http.StatusServiceUnavailable
 	WriteBytes(w, r, &res, &b, true)
-	checkResponse(t, w, res.Code, "max-age=10", "", err503)
+	checkResponse(t, w, res.Code, "max-age=10", "", pageNonce(w, err503))
 
 	w = httptest.NewRecorder()
 	res.Code = http.StatusBadRequest
 	WriteBytes(w, r, &res, &b, true)
-	checkResponse(t, w, res.Code, "max-age=86400", "", err400)
+	checkResponse(t, w, res.Code, "max-age=86400", "", pageNonce(w, err400))
 
 	w = httptest.NewRecorder()
 	res.Code = http.StatusMethodNotAllowed
 	WriteBytes(w, r, &res, &b, true)
-	checkResponse(t, w, res.Code, "max-age=86400", "", err405)
+	checkResponse(t, w, res.Code, "max-age=86400", "", pageNonce(w, err405))
 
 	w = httptest.NewRecorder()
 	res.Code = 999
 	WriteBytes(w, r, &res, &b, true)
-	checkResponse(t, w, 999, "max-age=10", "", err503)
+	checkResponse(t, w, 999, "max-age=10", "", pageNonce(w, err503))
 }
 
 func TestWrite(t *testing.T) {
@@ -220,6 +715,200 @@ func TestWrite(t *testing.T) {
 }
 
 
+func TestWriteSurrogateKeys(t *testing.T) {
+	r, err := http.NewRequest("GET", "http://test.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+
+	res := Result{Code: http.StatusOK, SurrogateKeys: []string{"quake", "quake-2016p123456"}}
+
+	w := httptest.NewRecorder()
+	WriteBytes(w, r, &res, &b, false)
+	if w.Header().Get("Surrogate-Key") != "quake quake-2016p123456" {
+		t.Errorf("expected Surrogate-Key quake quake-2016p123456 got %s", w.Header().Get("Surrogate-Key"))
+	}
+
+	w = httptest.NewRecorder()
+	Write(w, r, &res)
+	if w.Header().Get("Surrogate-Key") != "quake quake-2016p123456" {
+		t.Errorf("expected Surrogate-Key quake quake-2016p123456 got %s", w.Header().Get("Surrogate-Key"))
+	}
+
+	res.SurrogateKeys = []string{}
+
+	w = httptest.NewRecorder()
+	WriteBytes(w, r, &res, &b, false)
+	if _, ok := w.Header()["Surrogate-Key"]; ok {
+		t.Error("expected no Surrogate-Key header for empty keys")
+	}
+
+	w = httptest.NewRecorder()
+	Write(w, r, &res)
+	if _, ok := w.Header()["Surrogate-Key"]; ok {
+		t.Error("expected no Surrogate-Key header for empty keys")
+	}
+}
+
+func TestWriteAccepted(t *testing.T) {
+	r, err := http.NewRequest("POST", "http://test.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+
+	res := Accepted("/job/1234/status")
+
+	w := httptest.NewRecorder()
+	WriteBytes(w, r, res, &b, true)
+	checkResponse(t, w, http.StatusAccepted, "max-age=10", "", "")
+
+	if w.Header().Get("Location") != "/job/1234/status" {
+		t.Errorf("expected Location /job/1234/status got %s", w.Header().Get("Location"))
+	}
+
+	if w.Header().Get("Content-Type") == "text/html; charset=utf-8" {
+		t.Error("error page Content-Type for 202")
+	}
+
+	w = httptest.NewRecorder()
+	Write(w, r, res)
+	checkResponse(t, w, http.StatusAccepted, "max-age=10", "", "")
+
+	if w.Header().Get("Location") != "/job/1234/status" {
+		t.Errorf("expected Location /job/1234/status got %s", w.Header().Get("Location"))
+	}
+}
+
+func TestWriteAge(t *testing.T) {
+	r, err := http.NewRequest("GET", "http://test.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+
+	res := Result{Code: http.StatusOK, Age: 90*time.Second + 500*time.Millisecond}
+
+	w := httptest.NewRecorder()
+	WriteBytes(w, r, &res, &b, false)
+	if w.Header().Get("Age") != "90" {
+		t.Errorf("expected Age 90 got %s", w.Header().Get("Age"))
+	}
+
+	w = httptest.NewRecorder()
+	Write(w, r, &res)
+	if w.Header().Get("Age") != "90" {
+		t.Errorf("expected Age 90 got %s", w.Header().Get("Age"))
+	}
+
+	res.Age = 0
+
+	w = httptest.NewRecorder()
+	WriteBytes(w, r, &res, &b, false)
+	if _, ok := w.Header()["Age"]; ok {
+		t.Error("expected no Age header for zero age")
+	}
+}
+
+func TestWriteRetryAfter(t *testing.T) {
+	r, err := http.NewRequest("GET", "http://test.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	in := []struct {
+		res        *Result
+		retryAfter string
+	}{
+		{ServiceUnavailableAfter(30*time.Second, errors.New("busy")), "30"},
+		{ServiceUnavailableAfter(1500*time.Millisecond, errors.New("busy")), "2"},
+		{ServiceUnavailableError(errors.New("busy")), ""},
+	}
+
+	for _, v := range in {
+		var b bytes.Buffer
+
+		w := httptest.NewRecorder()
+		WriteBytes(w, r, v.res, &b, false)
+		checkResponse(t, w, http.StatusServiceUnavailable, "max-age=10", "", "busy")
+
+		if _, ok := w.Header()["Retry-After"]; ok != (v.retryAfter != "") || w.Header().Get("Retry-After") != v.retryAfter {
+			t.Errorf("WriteBytes expected Retry-After %q got %q", v.retryAfter, w.Header().Get("Retry-After"))
+		}
+
+		w = httptest.NewRecorder()
+		Write(w, r, v.res)
+		checkResponse(t, w, http.StatusServiceUnavailable, "max-age=10", "", "busy")
+
+		if w.Header().Get("Retry-After") != v.retryAfter {
+			t.Errorf("Write expected Retry-After %q got %q", v.retryAfter, w.Header().Get("Retry-After"))
+		}
+	}
+}
+
+func TestWriteStaleWhileRevalidate(t *testing.T) {
+	r, err := http.NewRequest("GET", "http://test.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+
+	res := Result{Code: http.StatusOK, StaleWhileRevalidate: time.Minute}
+
+	w := httptest.NewRecorder()
+	WriteBytes(w, r, &res, &b, false)
+	checkResponse(t, w, http.StatusOK, "max-age=10, stale-while-revalidate=60", "", "")
+
+	if w.Header().Get("Cache-Control") != "max-age=10, stale-while-revalidate=60" {
+		t.Errorf("expected Cache-Control max-age=10, stale-while-revalidate=60 got %s", w.Header().Get("Cache-Control"))
+	}
+
+	// appended to Surrogate-Control and Cache-Control set by the handler.
+	w = httptest.NewRecorder()
+	w.Header().Set("Surrogate-Control", "max-age=300")
+	w.Header().Set("Cache-Control", "max-age=60")
+	Write(w, r, &res)
+	checkResponse(t, w, http.StatusOK, "max-age=300, stale-while-revalidate=60", "", "")
+
+	if w.Header().Get("Cache-Control") != "max-age=60, stale-while-revalidate=60" {
+		t.Errorf("expected Cache-Control max-age=60, stale-while-revalidate=60 got %s", w.Header().Get("Cache-Control"))
+	}
+
+	// not without a max-age.
+	w = httptest.NewRecorder()
+	w.Header().Set("Surrogate-Control", "no-store")
+	Write(w, r, &res)
+	checkResponse(t, w, http.StatusOK, "no-store", "", "")
+
+	if w.Header().Get("Cache-Control") != "" {
+		t.Errorf("expected no Cache-Control got %s", w.Header().Get("Cache-Control"))
+	}
+
+	w = httptest.NewRecorder()
+	w.Header().Set("Cache-Control", "no-cache")
+	Write(w, r, &res)
+	checkResponse(t, w, http.StatusOK, "max-age=10, stale-while-revalidate=60", "", "")
+
+	if w.Header().Get("Cache-Control") != "no-cache" {
+		t.Errorf("expected Cache-Control no-cache got %s", w.Header().Get("Cache-Control"))
+	}
+
+	// not for errors.
+	res.Code = http.StatusNotFound
+	w = httptest.NewRecorder()
+	Write(w, r, &res)
+	checkResponse(t, w, http.StatusNotFound, "max-age=10", "", "")
+
+	if w.Header().Get("Cache-Control") != "" {
+		t.Errorf("expected no Cache-Control got %s", w.Header().Get("Cache-Control"))
+	}
+}
+
 /*
 Before and after benchmarks for adding bytes.Buffer pool. Also compare passing nil &bytes.Buffer
 for non GET requests in MakeHandlerAPI.  Faster, fewer allocations (less work for the garbage collector).
@@ -342,6 +1031,27 @@ func checkResponse(t *testing.T, w *httptest.ResponseRecorder, code int, surroga
 		var b bytes.Buffer
 		b.ReadFrom(gz)
 
+		if b.String() != body {
+			t.Errorf("%s got wrong body", l)
+		}
+	case "br":
+		var b bytes.Buffer
+		b.ReadFrom(brotli.NewReader(w.Body))
+
+		if b.String() != body {
+			t.Errorf("%s got wrong body", l)
+		}
+	case "deflate":
+		f, err := zlib.NewReader(w.Body)
+		if err != nil {
+			t.Errorf("%s reading deflate body: %s", l, err)
+			return
+		}
+		defer f.Close()
+
+		var b bytes.Buffer
+		b.ReadFrom(f)
+
 		if b.String() != body {
 			t.Errorf("%s got wrong body", l)
 		}
@@ -352,8 +1062,425 @@ func checkResponse(t *testing.T, w *httptest.ResponseRecorder, code int, surroga
 	}
 }
 
+// pageNonce returns page with the nonce from the Content-Security-Policy header of w added to the style tags.
+func pageNonce(w *httptest.ResponseRecorder, page string) string {
+	c := w.Header().Get("Content-Security-Policy")
+
+	i := strings.Index(c, "'nonce-")
+	if i < 0 {
+		return page
+	}
+
+	n := c[i+7:]
+	n = n[:strings.Index(n, "'")]
+
+	return strings.Replace(page, "<style>", `<style nonce="`+n+`">`, -1)
+}
+
 // loc returns a string representing the line of code 2 functions calls back.
 func loc() (loc string) {
 	_, _, l, _ := runtime.Caller(2)
 	return "L" + strconv.Itoa(l)
 }
+
+func TestDefaultTimeout(t *testing.T) {
+	defer func() { DefaultTimeout = 0 }()
+	DefaultTimeout = 50 * time.Millisecond
+
+	fast := func(r *http.Request, h http.Header, b *bytes.Buffer) *Result {
+		if _, ok := r.Context().Deadline(); !ok {
+			t.Error("expected a deadline on the request context")
+		}
+		b.WriteString("ok")
+		return &StatusOK
+	}
+
+	slow := func(r *http.Request, h http.Header, b *bytes.Buffer) *Result {
+		<-r.Context().Done()
+		return &StatusOK
+	}
+
+	in := []struct {
+		f    RequestHandler
+		code int
+	}{
+		{fast, http.StatusOK},
+		{slow, http.StatusServiceUnavailable},
+	}
+
+	for i, v := range in {
+		r := httptest.NewRequest("GET", "http://test.com", nil)
+
+		w := httptest.NewRecorder()
+		MakeHandlerAPI(v.f).ServeHTTP(w, r)
+
+		if w.Code != v.code {
+			t.Errorf("%d api expected status %d got %d", i, v.code, w.Code)
+		}
+
+		w = httptest.NewRecorder()
+		MakeHandlerPage(v.f).ServeHTTP(w, r)
+
+		if w.Code != v.code {
+			t.Errorf("%d page expected status %d got %d", i, v.code, w.Code)
+		}
+	}
+
+	// no deadline by default
+	DefaultTimeout = 0
+
+	h := func(r *http.Request, h http.Header, b *bytes.Buffer) *Result {
+		if _, ok := r.Context().Deadline(); ok {
+			t.Error("expected no deadline on the request context")
+		}
+		return &StatusOK
+	}
+
+	MakeHandlerAPI(h).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://test.com", nil))
+}
+
+func TestPanic(t *testing.T) {
+	h := func(r *http.Request, h http.Header, b *bytes.Buffer) *Result {
+		if b != nil {
+			b.WriteString("partial")
+		}
+		panic("secret connection string")
+	}
+
+	in := []struct {
+		handler     http.HandlerFunc
+		method      string
+		contentType string
+		body        string
+	}{
+		{MakeHandlerAPI(h), "GET", "text/plain; charset=utf-8", "internal server error"},
+		{MakeHandlerAPI(h), "POST", "", "internal server error"},
+		{MakeHandlerPage(h), "GET", "text/html; charset=utf-8", "<html"},
+	}
+
+	for _, v := range in {
+		w := httptest.NewRecorder()
+		v.handler.ServeHTTP(w, httptest.NewRequest(v.method, "http://test.com", nil))
+
+		if w.Code != http.StatusInternalServerError {
+			t.Errorf("%s expected status %d got %d", v.method, http.StatusInternalServerError, w.Code)
+		}
+
+		if v.contentType != "" && w.Header().Get("Content-Type") != v.contentType {
+			t.Errorf("%s expected Content-Type %s got %s", v.method, v.contentType, w.Header().Get("Content-Type"))
+		}
+
+		if !strings.Contains(w.Body.String(), v.body) {
+			t.Errorf("%s expected body containing %s got %s", v.method, v.body, w.Body.String())
+		}
+
+		if strings.Contains(w.Body.String(), "secret") || strings.Contains(w.Body.String(), "partial") {
+			t.Errorf("%s panic value or partial body leaked to the client: %s", v.method, w.Body.String())
+		}
+	}
+}
+
+func TestStripHopByHop(t *testing.T) {
+	h := func(r *http.Request, h http.Header, b *bytes.Buffer) *Result {
+		h.Set("Connection", "keep-alive, X-Internal")
+		h.Set("Keep-Alive", "timeout=5")
+		h.Set("Transfer-Encoding", "chunked")
+		h.Set("Upgrade", "h2c")
+		h.Set("X-Internal", "secret")
+		h.Set("X-Custom", "kept")
+		h.Set("Cache-Control", "max-age=60")
+		h.Set("Trailer", "X-Checksum")
+		if b != nil {
+			b.WriteString("ok")
+		}
+		return &StatusOK
+	}
+
+	for _, method := range []string{"GET", "PUT"} {
+		w := httptest.NewRecorder()
+		MakeHandlerAPI(h).ServeHTTP(w, httptest.NewRequest(method, "http://test.com", nil))
+
+		for _, k := range []string{"Connection", "Keep-Alive", "Transfer-Encoding", "Upgrade", "X-Internal"} {
+			if v := w.Header().Get(k); v != "" {
+				t.Errorf("%s expected %s to be removed got %s", method, k, v)
+			}
+		}
+
+		for _, k := range []string{"X-Custom", "Cache-Control", "Surrogate-Control", "Trailer"} {
+			if w.Header().Get(k) == "" {
+				t.Errorf("%s expected %s to be kept", method, k)
+			}
+		}
+	}
+
+	// Connection: close is kept so that net/http closes the connection.
+	closing := func(r *http.Request, h http.Header, b *bytes.Buffer) *Result {
+		h.Set("Connection", "close, X-Internal")
+		h.Set("X-Internal", "secret")
+		return &StatusOK
+	}
+
+	w := httptest.NewRecorder()
+	MakeHandlerAPI(closing).ServeHTTP(w, httptest.NewRequest("GET", "http://test.com", nil))
+
+	if w.Header().Get("Connection") != "close" {
+		t.Errorf("expected Connection close got %q", w.Header().Get("Connection"))
+	}
+
+	if w.Header().Get("X-Internal") != "" {
+		t.Error("expected X-Internal to be removed")
+	}
+
+	defer func(h []string) { HopByHopHeaders = h }(HopByHopHeaders)
+	HopByHopHeaders = []string{"X-Custom"}
+
+	w = httptest.NewRecorder()
+	MakeHandlerAPI(h).ServeHTTP(w, httptest.NewRequest("GET", "http://test.com", nil))
+
+	if w.Header().Get("X-Custom") != "" {
+		t.Error("expected X-Custom to be removed")
+	}
+
+	if w.Header().Get("Upgrade") != "h2c" {
+		t.Error("expected Upgrade to be kept when not in HopByHopHeaders")
+	}
+}
+
+func TestMetricsCallback(t *testing.T) {
+	defer SetMetricsCallback(nil)
+
+	var path string
+	var code int
+	var taken time.Duration
+
+	SetMetricsCallback(func(p string, c int, d time.Duration) {
+		path, code, taken = p, c, d
+	})
+
+	slow := func(r *http.Request, h http.Header, b *bytes.Buffer) *Result {
+		time.Sleep(5 * time.Millisecond)
+		return &StatusOK
+	}
+
+	notFound := func(r *http.Request, h http.Header, b *bytes.Buffer) *Result {
+		return &NotFound
+	}
+
+	in := []struct {
+		handler http.HandlerFunc
+		method  string
+		url     string
+		path    string
+		code    int
+	}{
+		{MakeHandlerAPI(slow), "GET", "http://test.com/quake?publicID=2016p123456", "/quake", http.StatusOK},
+		{MakeHandlerAPI(slow), "PUT", "http://test.com/quake", "/quake", http.StatusOK},
+		{MakeHandlerPage(slow), "GET", "http://test.com/map", "/map", http.StatusOK},
+		{MakeHandlerAPI(notFound), "GET", "http://test.com/missing", "/missing", http.StatusNotFound},
+		{MakeHandlerPage(notFound), "GET", "http://test.com/missing", "/missing", http.StatusNotFound},
+	}
+
+	for _, v := range in {
+		path, code, taken = "", 0, 0
+
+		v.handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(v.method, v.url, nil))
+
+		if path != v.path {
+			t.Errorf("%s %s expected path %s got %s", v.method, v.url, v.path, path)
+		}
+
+		if code != v.code {
+			t.Errorf("%s %s expected code %d got %d", v.method, v.url, v.code, code)
+		}
+
+		if v.code == http.StatusOK && taken < 5*time.Millisecond {
+			t.Errorf("%s %s expected at least 5ms got %s", v.method, v.url, taken)
+		}
+	}
+
+	// no callback
+	SetMetricsCallback(nil)
+	path = ""
+
+	MakeHandlerAPI(slow).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://test.com/quake", nil))
+
+	if path != "" {
+		t.Error("expected the callback not to be called")
+	}
+}
+
+func TestMakeHandlerTimeout(t *testing.T) {
+	defer func() { DefaultTimeout = 0 }()
+
+	slow := func(r *http.Request, h http.Header, b *bytes.Buffer) *Result {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(200 * time.Millisecond):
+			if b != nil {
+				b.WriteString("ok")
+			}
+		}
+		return &StatusOK
+	}
+
+	in := []struct {
+		id             string
+		timeout        time.Duration
+		defaultTimeout time.Duration
+		code           int
+	}{
+		{"exceeded", 20 * time.Millisecond, 0, http.StatusServiceUnavailable},
+		{"not exceeded", time.Second, 0, http.StatusOK},
+		{"disabled", 0, 0, http.StatusOK},
+		{"overrides shorter default", time.Second, 20 * time.Millisecond, http.StatusOK},
+		{"overrides longer default", 20 * time.Millisecond, time.Second, http.StatusServiceUnavailable},
+	}
+
+	for _, v := range in {
+		DefaultTimeout = v.defaultTimeout
+
+		for _, method := range []string{"GET", "PUT"} {
+			w := httptest.NewRecorder()
+			MakeHandlerTimeout(slow, v.timeout).ServeHTTP(w, httptest.NewRequest(method, "http://test.com", nil))
+
+			if w.Code != v.code {
+				t.Errorf("%s %s expected status %d got %d", v.id, method, v.code, w.Code)
+			}
+		}
+	}
+}
+
+func TestWriteHead(t *testing.T) {
+	body := strings.Repeat("bogan impsum ", 20)
+
+	h := func(r *http.Request, h http.Header, b *bytes.Buffer) *Result {
+		h.Set("Content-Type", "text/plain")
+		if b != nil {
+			b.WriteString(body)
+		}
+		return &StatusOK
+	}
+
+	makers := []struct {
+		id   string
+		make func(RequestHandler) http.HandlerFunc
+	}{
+		{"page", MakeHandlerPage},
+		{"api", MakeHandlerAPI},
+	}
+
+	for _, m := range makers {
+		for _, enc := range []string{"", "gzip", "br"} {
+			get := httptest.NewRequest("GET", "http://test.com", nil)
+			get.Header.Set("Accept-Encoding", enc)
+			head := httptest.NewRequest("HEAD", "http://test.com", nil)
+			head.Header.Set("Accept-Encoding", enc)
+
+			wg := httptest.NewRecorder()
+			m.make(h).ServeHTTP(wg, get)
+
+			wh := httptest.NewRecorder()
+			m.make(h).ServeHTTP(wh, head)
+
+			if wh.Code != wg.Code {
+				t.Errorf("%s %q expected status %d got %d", m.id, enc, wg.Code, wh.Code)
+			}
+
+			for _, k := range []string{"Content-Length", "Content-Encoding", "Content-Type", "ETag", "Surrogate-Control", "Vary"} {
+				if wh.Header().Get(k) != wg.Header().Get(k) {
+					t.Errorf("%s %q expected %s %s got %s", m.id, enc, k, wg.Header().Get(k), wh.Header().Get(k))
+				}
+			}
+
+			if wg.Body.Len() == 0 {
+				t.Errorf("%s %q expected a body for GET", m.id, enc)
+			}
+
+			if wh.Body.Len() != 0 {
+				t.Errorf("%s %q expected no body for HEAD got %d bytes", m.id, enc, wh.Body.Len())
+			}
+		}
+
+		w := httptest.NewRecorder()
+		m.make(h).ServeHTTP(w, httptest.NewRequest("HEAD", "http://test.com", nil))
+
+		if w.Header().Get("Content-Length") != strconv.Itoa(len(body)) {
+			t.Errorf("%s expected Content-Length %d got %s", m.id, len(body), w.Header().Get("Content-Length"))
+		}
+
+		if w.Header().Get("ETag") == "" {
+			t.Errorf("%s expected an ETag", m.id)
+		}
+	}
+
+	// errors from Write
+	w := httptest.NewRecorder()
+	Write(w, httptest.NewRequest("HEAD", "http://test.com", nil), &NotFound)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status %d got %d", http.StatusNotFound, w.Code)
+	}
+
+	if w.Header().Get("Surrogate-Control") != "max-age=10" {
+		t.Errorf("expected Surrogate-Control max-age=10 got %s", w.Header().Get("Surrogate-Control"))
+	}
+
+	if w.Body.Len() != 0 {
+		t.Errorf("expected no body for HEAD got %s", w.Body.String())
+	}
+}
+
+func TestSetErrorPage(t *testing.T) {
+	defer func(p []byte) { SetErrorPage(http.StatusNotFound, p) }(errorPages[http.StatusNotFound])
+
+	custom := "<html><head><style>h1 {color: red}</style></head><body><h1>Not here</h1></body></html>"
+	SetErrorPage(http.StatusNotFound, []byte(custom))
+
+	h := func(r *http.Request, h http.Header, b *bytes.Buffer) *Result {
+		if r.URL.Path == "/busy" {
+			return ServiceUnavailableError(errors.New("busy"))
+		}
+		return &NotFound
+	}
+
+	w := httptest.NewRecorder()
+	MakeHandlerPage(h).ServeHTTP(w, httptest.NewRequest("GET", "http://test.com/missing", nil))
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status %d got %d", http.StatusNotFound, w.Code)
+	}
+
+	// the error page has the nonce from the Content-Security-Policy.
+	csp := w.Header().Get("Content-Security-Policy")
+	n := csp[strings.Index(csp, "'nonce-")+7:]
+	n = n[:strings.Index(n, "'")]
+
+	expected := strings.Replace(custom, "<style>", `<style nonce="`+n+`">`, 1)
+	if w.Body.String() != expected {
+		t.Errorf("expected custom page %s got %s", expected, w.Body.String())
+	}
+
+	// built in pages are used for other codes
+	w = httptest.NewRecorder()
+	MakeHandlerPage(h).ServeHTTP(w, httptest.NewRequest("GET", "http://test.com/busy", nil))
+
+	if !strings.Contains(w.Body.String(), "GeoNet Busy") {
+		t.Errorf("expected the built in 503 page got %s", w.Body.String())
+	}
+}
+
+func TestPanicAbortHandler(t *testing.T) {
+	h := func(r *http.Request, h http.Header, b *bytes.Buffer) *Result {
+		panic(http.ErrAbortHandler)
+	}
+
+	defer func() {
+		if p := recover(); p != http.ErrAbortHandler {
+			t.Errorf("expected http.ErrAbortHandler to be passed on got %v", p)
+		}
+	}()
+
+	MakeHandlerAPI(h).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://test.com", nil))
+
+	t.Error("expected a panic")
+}
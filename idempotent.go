@@ -0,0 +1,171 @@
+package weft
+
+import (
+	"bytes"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// IdempotentResponse is a response stored by Idempotent for replay.
+type IdempotentResponse struct {
+	Result Result
+	Header http.Header // the headers set or changed by the handler
+	Body   []byte
+}
+
+// IdempotencyStore stores responses for Idempotent.
+type IdempotencyStore interface {
+	// Get returns the response stored for key and true or false if there is none.
+	Get(key string) (IdempotentResponse, bool)
+	// Put stores resp for key.
+	Put(key string, resp IdempotentResponse)
+}
+
+type memoryEntry struct {
+	resp    IdempotentResponse
+	expires time.Time
+}
+
+type memoryIdempotencyStore struct {
+	sync.Mutex
+	ttl   time.Duration
+	m     map[string]memoryEntry
+	swept time.Time // when expired responses were last removed
+}
+
+// NewMemoryIdempotencyStore returns an in memory IdempotencyStore.
+// Responses expire after ttl.
+func NewMemoryIdempotencyStore(ttl time.Duration) IdempotencyStore {
+	return &memoryIdempotencyStore{ttl: ttl, m: make(map[string]memoryEntry), swept: time.Now()}
+}
+
+func (s *memoryIdempotencyStore) Get(key string) (IdempotentResponse, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	e, ok := s.m[key]
+	if !ok {
+		return IdempotentResponse{}, false
+	}
+
+	if time.Now().After(e.expires) {
+		delete(s.m, key)
+		return IdempotentResponse{}, false
+	}
+
+	return e.resp, true
+}
+
+func (s *memoryIdempotencyStore) Put(key string, resp IdempotentResponse) {
+	s.Lock()
+	defer s.Unlock()
+
+	now := time.Now()
+
+	// remove expired responses so the store doesn't grow without bound.  Sweeping at most
+	// once per ttl keeps the cost of Put constant when amortised over many calls.
+	if now.Sub(s.swept) > s.ttl {
+		for k, e := range s.m {
+			if now.After(e.expires) {
+				delete(s.m, k)
+			}
+		}
+		s.swept = now
+	}
+
+	s.m[key] = memoryEntry{resp: resp, expires: now.Add(s.ttl)}
+}
+
+/*
+Idempotent wraps h so that retried requests with unsafe methods (POST, PUT, PATCH, DELETE)
+get the same response.  The first response for each Idempotency-Key request header is stored
+in store and replayed, without calling h, for later requests with the same key, method, and path.
+
+Only the headers set or changed by h are stored and replayed.  Headers set before h is
+called, such as X-Request-Id from MakeHandlerAPI, are left as they are for the new request.
+
+Requests without an Idempotency-Key header are passed to h.  5xx responses are not stored
+so the request can be retried.  Concurrent requests with the same key may both be passed to h.
+
+Keys are not scoped to a client.  Any client that sends the same key for the same method and
+path gets the stored response, so clients should use unguessable keys e.g., random UUIDs, and
+Idempotent should not be used for responses that are private to a client.
+*/
+func Idempotent(store IdempotencyStore, h RequestHandler) RequestHandler {
+	return func(r *http.Request, header http.Header, b *bytes.Buffer) *Result {
+		switch r.Method {
+		case "POST", "PUT", "PATCH", "DELETE":
+		default:
+			return h(r, header, b)
+		}
+
+		k := r.Header.Get("Idempotency-Key")
+		if k == "" {
+			return h(r, header, b)
+		}
+
+		k = r.Method + " " + r.URL.Path + " " + k
+
+		if s, ok := store.Get(k); ok {
+			for n, v := range s.Header {
+				header[n] = append([]string(nil), v...)
+			}
+
+			if b != nil {
+				b.Write(s.Body)
+			}
+
+			res := s.Result
+			return &res
+		}
+
+		before := copyHeader(header)
+
+		res := h(r, header, b)
+
+		if res.Code < http.StatusInternalServerError {
+			s := IdempotentResponse{Result: *res, Header: http.Header{}}
+
+			for n, v := range header {
+				if !equalValues(before[n], v) {
+					s.Header[n] = append([]string(nil), v...)
+				}
+			}
+
+			if b != nil {
+				s.Body = append([]byte(nil), b.Bytes()...)
+			}
+
+			store.Put(k, s)
+		}
+
+		return res
+	}
+}
+
+// copyHeader returns a copy of h.
+func copyHeader(h http.Header) http.Header {
+	c := make(http.Header, len(h))
+
+	for n, v := range h {
+		c[n] = append([]string(nil), v...)
+	}
+
+	return c
+}
+
+// equalValues returns true if a and b hold the same header values in the same order.
+func equalValues(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,159 @@
+package weft
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestIdempotent(t *testing.T) {
+	var calls int
+
+	h := func(r *http.Request, h http.Header, b *bytes.Buffer) *Result {
+		calls++
+		h.Set("X-Call", strconv.Itoa(calls))
+		if b != nil {
+			b.WriteString("call " + strconv.Itoa(calls))
+		}
+		return &Result{Ok: true, Code: http.StatusCreated, Location: "/job/" + strconv.Itoa(calls)}
+	}
+
+	f := Idempotent(NewMemoryIdempotencyStore(50*time.Millisecond), h)
+
+	do := func(method, key string) (*Result, http.Header, string) {
+		r, err := http.NewRequest(method, "http://test.com/job", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if key != "" {
+			r.Header.Set("Idempotency-Key", key)
+		}
+
+		header := http.Header{}
+		var b bytes.Buffer
+
+		res := f(r, header, &b)
+
+		return res, header, b.String()
+	}
+
+	// first request
+	res, header, body := do("POST", "abc")
+	if calls != 1 || res.Location != "/job/1" || header.Get("X-Call") != "1" || body != "call 1" {
+		t.Errorf("unexpected first response %d %s %s %s", calls, res.Location, header.Get("X-Call"), body)
+	}
+
+	// duplicate is replayed
+	res, header, body = do("POST", "abc")
+	if calls != 1 {
+		t.Errorf("expected duplicate to be replayed, handler called %d times", calls)
+	}
+
+	if res.Code != http.StatusCreated || res.Location != "/job/1" || header.Get("X-Call") != "1" || body != "call 1" {
+		t.Errorf("unexpected replayed response %d %s %s %s", res.Code, res.Location, header.Get("X-Call"), body)
+	}
+
+	// different key, method, or no key calls the handler
+	do("POST", "def")
+	if calls != 2 {
+		t.Errorf("expected new key to call the handler got %d calls", calls)
+	}
+
+	do("PUT", "abc")
+	if calls != 3 {
+		t.Errorf("expected new method to call the handler got %d calls", calls)
+	}
+
+	do("POST", "")
+	if calls != 4 {
+		t.Errorf("expected no key to call the handler got %d calls", calls)
+	}
+
+	// safe methods are not stored.
+	do("GET", "ghi")
+	do("GET", "ghi")
+	if calls != 6 {
+		t.Errorf("expected GET to call the handler got %d calls", calls)
+	}
+
+	// key expiry
+	time.Sleep(60 * time.Millisecond)
+
+	res, _, body = do("POST", "abc")
+	if calls != 7 {
+		t.Errorf("expected expired key to call the handler got %d calls", calls)
+	}
+
+	if res.Location != "/job/7" || body != "call 7" {
+		t.Errorf("unexpected response after expiry %s %s", res.Location, body)
+	}
+}
+
+func TestIdempotentRequestID(t *testing.T) {
+	var calls int
+
+	h := MakeHandlerAPI(Idempotent(NewMemoryIdempotencyStore(time.Minute), func(r *http.Request, h http.Header, b *bytes.Buffer) *Result {
+		calls++
+		h.Set("X-Call", strconv.Itoa(calls))
+		return &Result{Ok: true, Code: http.StatusCreated}
+	}))
+
+	var ids []string
+
+	for i := 0; i < 2; i++ {
+		r := httptest.NewRequest("POST", "http://test.com/job", nil)
+		r.Header.Set("Idempotency-Key", "abc")
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		if w.Code != http.StatusCreated || w.Header().Get("X-Call") != "1" {
+			t.Errorf("%d unexpected response %d %s", i, w.Code, w.Header().Get("X-Call"))
+		}
+
+		ids = append(ids, w.Header().Get("X-Request-Id"))
+	}
+
+	if calls != 1 {
+		t.Errorf("expected duplicate to be replayed, handler called %d times", calls)
+	}
+
+	// the replay has the ID of the new request, not the stored one.
+	if ids[0] == "" || ids[0] == ids[1] {
+		t.Errorf("expected a new X-Request-Id for the replay got %v", ids)
+	}
+}
+
+func TestMemoryIdempotencyStoreSweep(t *testing.T) {
+	s := NewMemoryIdempotencyStore(20 * time.Millisecond).(*memoryIdempotencyStore)
+
+	s.Put("a", IdempotentResponse{})
+	time.Sleep(30 * time.Millisecond)
+
+	// a has expired and is removed by the sweep.
+	s.Put("b", IdempotentResponse{})
+	if _, ok := s.m["a"]; ok {
+		t.Error("expected a to be removed")
+	}
+
+	// b expires but there is no sweep until ttl after the last one.
+	s.swept = time.Now()
+	s.m["b"] = memoryEntry{expires: time.Now().Add(-time.Millisecond)}
+	s.Put("c", IdempotentResponse{})
+	if _, ok := s.m["b"]; !ok {
+		t.Error("expected b to be kept until the next sweep")
+	}
+
+	// expired responses are never returned.
+	if _, ok := s.Get("b"); ok {
+		t.Error("expected no response for expired b")
+	}
+
+	if _, ok := s.Get("c"); !ok {
+		t.Error("expected a response for c")
+	}
+}
@@ -0,0 +1,125 @@
+package weft
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Now returns the current time for timestamps in responses.  It can be replaced in tests.
+var Now = time.Now
+
+type envelope struct {
+	Timestamp string          `json:"timestamp"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// dataEnvelope is the envelope for Result.Data.  It is encoded by WriteBytes and Write.
+type dataEnvelope struct {
+	Timestamp string      `json:"timestamp"`
+	Data      interface{} `json:"data"`
+}
+
+type errorBody struct {
+	Error errorDetail `json:"error"`
+}
+
+type errorDetail struct {
+	Code      int    `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// errorJSON returns res as a JSON error object for the json error mode of WriteBytes and Write.
+// The request ID for r is included for 5xx errors.
+func errorJSON(r *http.Request, res *Result) []byte {
+	m := res.Msg
+	if m == "" {
+		m = http.StatusText(res.Code)
+	}
+
+	b, _ := json.Marshal(errorBody{Error: errorDetail{Code: res.Code, Message: m, RequestID: serverErrorID(r, res)}})
+
+	return b
+}
+
+/*
+JSONError returns BadRequest for err from decoding a JSON request body.  Where possible
+the message includes the offset of the error in the body and the field that could not
+be decoded to help the client fix the request e.g.,
+
+	if err := json.NewDecoder(r.Body).Decode(&q); err != nil {
+		return weft.JSONError(err)
+	}
+*/
+func JSONError(err error) *Result {
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		return BadRequest("invalid JSON at offset " + strconv.FormatInt(e.Offset, 10) + ": " + e.Error())
+	case *json.UnmarshalTypeError:
+		m := "invalid value"
+		if e.Field != "" {
+			m += " for field " + e.Field
+		}
+		return BadRequest(m + " at offset " + strconv.FormatInt(e.Offset, 10) +
+			": expected " + e.Type.String() + " got " + e.Value)
+	}
+
+	switch err {
+	case io.EOF:
+		return BadRequest("empty JSON body")
+	case io.ErrUnexpectedEOF:
+		return BadRequest("invalid JSON: unexpected end of input")
+	}
+
+	return BadRequest("invalid JSON: " + err.Error())
+}
+
+/*
+Envelope wraps h so that the JSON body h writes to b is returned in a standard envelope
+with the server time from Now in RFC3339 format e.g.,
+
+	{"timestamp":"2016-01-02T03:04:05Z","data":{"publicID":"2016p123456"}}
+
+Only 2xx responses with a non empty body or with res.Data, e.g., from JSON, are wrapped.
+res.Data is wrapped in a copy of res so that it is encoded in the envelope.
+InternalServerError is returned if the body from h is not valid JSON.
+*/
+func Envelope(h RequestHandler) RequestHandler {
+	return func(r *http.Request, header http.Header, b *bytes.Buffer) *Result {
+		res := h(r, header, b)
+		if !success(res.Code) {
+			return res
+		}
+
+		if res.Data != nil && (b == nil || b.Len() == 0) {
+			e := *res
+			e.Data = dataEnvelope{Timestamp: Now().UTC().Format(time.RFC3339), Data: res.Data}
+			return &e
+		}
+
+		if b == nil || b.Len() == 0 {
+			return res
+		}
+
+		e, err := json.Marshal(envelope{
+			Timestamp: Now().UTC().Format(time.RFC3339),
+			Data:      json.RawMessage(b.Bytes()),
+		})
+		if err != nil {
+			return InternalServerError(err)
+		}
+
+		b.Reset()
+		b.Write(e)
+
+		if header.Get("Content-Type") == "" {
+			header.Set("Content-Type", "application/json")
+		}
+
+		return res
+	}
+}
@@ -0,0 +1,326 @@
+package weft
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJSONError(t *testing.T) {
+	var q struct {
+		PublicID  string  `json:"publicID"`
+		Magnitude float64 `json:"magnitude"`
+	}
+
+	in := []struct {
+		body string
+		msg  string
+	}{
+		{`{"publicID": "2016p123456",}`, "invalid JSON at offset 28: invalid character '}' looking for beginning of object key string"},
+		{`{"publicID": "2016p123456", "magnitude": "big"}`, "invalid value for field magnitude at offset 46: expected float64 got string"},
+		{``, "empty JSON body"},
+		{`{"publicID": `, "invalid JSON: unexpected end of input"},
+	}
+
+	for _, v := range in {
+		err := json.NewDecoder(strings.NewReader(v.body)).Decode(&q)
+		if err == nil {
+			t.Fatalf("%s expected decode error", v.body)
+		}
+
+		res := JSONError(err)
+
+		if res.Code != http.StatusBadRequest {
+			t.Errorf("%s expected code %d got %d", v.body, http.StatusBadRequest, res.Code)
+		}
+
+		if res.Msg != v.msg {
+			t.Errorf("%s expected message\n%s got\n%s", v.body, v.msg, res.Msg)
+		}
+	}
+
+	// no field
+	var m float64
+
+	err := json.Unmarshal([]byte(`"big"`), &m)
+	if err == nil {
+		t.Fatal("expected decode error")
+	}
+
+	if res := JSONError(err); res.Msg != "invalid value at offset 5: expected float64 got string" {
+		t.Errorf("wrong message %s", res.Msg)
+	}
+}
+
+func TestEnvelope(t *testing.T) {
+	defer func() { Now = time.Now }()
+	Now = func() time.Time {
+		return time.Date(2016, 1, 2, 3, 4, 5, 0, time.FixedZone("NZDT", 13*3600))
+	}
+
+	in := []struct {
+		body string
+		code int
+		out  string
+	}{
+		{`{"publicID":"2016p123456"}`, http.StatusOK, `{"timestamp":"2016-01-01T14:04:05Z","data":{"publicID":"2016p123456"}}`},
+		{`[1,2,3]`, http.StatusOK, `{"timestamp":"2016-01-01T14:04:05Z","data":[1,2,3]}`},
+		{``, http.StatusOK, ``},
+		{`not json`, http.StatusOK, ""},
+	}
+
+	for _, v := range in {
+		h := func(r *http.Request, h http.Header, b *bytes.Buffer) *Result {
+			b.WriteString(v.body)
+			return &StatusOK
+		}
+
+		r := httptest.NewRequest("GET", "http://test.com/quake", nil)
+		b := &bytes.Buffer{}
+		header := http.Header{}
+
+		res := Envelope(h)(r, header, b)
+
+		if v.body == "not json" {
+			if res.Code != http.StatusInternalServerError {
+				t.Errorf("%s expected code %d got %d", v.body, http.StatusInternalServerError, res.Code)
+			}
+			continue
+		}
+
+		if res.Code != v.code {
+			t.Errorf("%s expected code %d got %d", v.body, v.code, res.Code)
+		}
+
+		if b.String() != v.out {
+			t.Errorf("%s expected body\n%s got\n%s", v.body, v.out, b.String())
+		}
+
+		if v.out != "" && header.Get("Content-Type") != "application/json" {
+			t.Errorf("%s expected Content-Type application/json got %s", v.body, header.Get("Content-Type"))
+		}
+	}
+
+	// errors are not wrapped
+	h := func(r *http.Request, h http.Header, b *bytes.Buffer) *Result {
+		b.WriteString(`{"error":"bad"}`)
+		return BadRequest("bad")
+	}
+
+	b := &bytes.Buffer{}
+	Envelope(h)(httptest.NewRequest("GET", "http://test.com/quake", nil), http.Header{}, b)
+
+	if b.String() != `{"error":"bad"}` {
+		t.Errorf("expected error body unchanged got %s", b.String())
+	}
+}
+
+func TestEnvelopeJSON(t *testing.T) {
+	defer func() { Now = time.Now }()
+	Now = func() time.Time {
+		return time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)
+	}
+
+	h := MakeHandlerAPI(Envelope(func(r *http.Request, h http.Header, b *bytes.Buffer) *Result {
+		return JSON(struct {
+			PublicID string `json:"publicID"`
+		}{"2016p123456"})
+	}))
+
+	expected := `{"timestamp":"2016-01-02T03:04:05Z","data":{"publicID":"2016p123456"}}`
+
+	for _, m := range []string{"GET", "POST"} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(m, "http://test.com/quake", nil))
+
+		if w.Code != http.StatusOK {
+			t.Errorf("%s expected code %d got %d", m, http.StatusOK, w.Code)
+		}
+
+		if w.Body.String() != expected {
+			t.Errorf("%s expected body\n%s got\n%s", m, expected, w.Body.String())
+		}
+
+		if w.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("%s expected Content-Type application/json got %s", m, w.Header().Get("Content-Type"))
+		}
+	}
+}
+
+func TestErrorModeJSON(t *testing.T) {
+	h := func(r *http.Request, h http.Header, b *bytes.Buffer) *Result {
+		h.Set("Weft-Error", "json")
+
+		switch r.URL.Path {
+		case "/bad":
+			return BadRequest("invalid value for parameter: limit")
+		case "/empty":
+			return &Result{Ok: false, Code: http.StatusBadRequest}
+		default:
+			return InternalServerError(errors.New("database unavailable"))
+		}
+	}
+
+	in := []struct {
+		id      string
+		handler http.HandlerFunc
+		method  string
+		path    string
+		code    int
+		message string
+	}{
+		{"api get 400", MakeHandlerAPI(h), "GET", "/bad", http.StatusBadRequest, "invalid value for parameter: limit"},
+		{"api put 400", MakeHandlerAPI(h), "PUT", "/bad", http.StatusBadRequest, "invalid value for parameter: limit"},
+		{"api get 500", MakeHandlerAPI(h), "GET", "/error", http.StatusInternalServerError, "database unavailable"},
+		{"api put 500", MakeHandlerAPI(h), "PUT", "/error", http.StatusInternalServerError, "database unavailable"},
+		{"page 400", MakeHandlerPage(h), "GET", "/bad", http.StatusBadRequest, "invalid value for parameter: limit"},
+		{"empty message", MakeHandlerAPI(h), "GET", "/empty", http.StatusBadRequest, "Bad Request"},
+	}
+
+	for _, v := range in {
+		w := httptest.NewRecorder()
+		v.handler.ServeHTTP(w, httptest.NewRequest(v.method, "http://test.com"+v.path, nil))
+
+		if w.Code != v.code {
+			t.Errorf("%s expected status %d got %d", v.id, v.code, w.Code)
+		}
+
+		if w.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("%s expected Content-Type application/json got %s", v.id, w.Header().Get("Content-Type"))
+		}
+
+		if w.Header().Get("Weft-Error") != "" {
+			t.Errorf("%s expected no Weft-Error header got %s", v.id, w.Header().Get("Weft-Error"))
+		}
+
+		var e struct {
+			Error struct {
+				Code      int    `json:"code"`
+				Message   string `json:"message"`
+				RequestID string `json:"request_id"`
+			} `json:"error"`
+		}
+
+		if err := json.Unmarshal(w.Body.Bytes(), &e); err != nil {
+			t.Errorf("%s invalid JSON %s: %s", v.id, w.Body.String(), err)
+			continue
+		}
+
+		if e.Error.Code != v.code {
+			t.Errorf("%s expected code %d got %d", v.id, v.code, e.Error.Code)
+		}
+
+		if e.Error.Message != v.message {
+			t.Errorf("%s expected message %s got %s", v.id, v.message, e.Error.Message)
+		}
+
+		if v.code == http.StatusInternalServerError && e.Error.RequestID != w.Header().Get("X-Request-Id") {
+			t.Errorf("%s expected request_id %s got %s", v.id, w.Header().Get("X-Request-Id"), e.Error.RequestID)
+		}
+
+		if v.code != http.StatusInternalServerError && e.Error.RequestID != "" {
+			t.Errorf("%s expected no request_id got %s", v.id, e.Error.RequestID)
+		}
+	}
+
+	// msg mode in a page handler
+	msg := func(r *http.Request, h http.Header, b *bytes.Buffer) *Result {
+		h.Set("Weft-Error", "msg")
+		return &NotFound
+	}
+
+	w := httptest.NewRecorder()
+	MakeHandlerPage(msg).ServeHTTP(w, httptest.NewRequest("GET", "http://test.com", nil))
+
+	if w.Body.String() != "not found" {
+		t.Errorf("expected body not found got %s", w.Body.String())
+	}
+}
+
+func TestResultData(t *testing.T) {
+	type quake struct {
+		PublicID  string    `json:"publicID"`
+		Magnitude float64   `json:"magnitude"`
+		Time      time.Time `json:"time"`
+	}
+
+	q := quake{PublicID: "2016p123456", Magnitude: 4.2, Time: time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)}
+
+	h := func(r *http.Request, h http.Header, b *bytes.Buffer) *Result {
+		switch r.URL.Path {
+		case "/geojson":
+			h.Set("Content-Type", "application/vnd.geo+json")
+			return JSON(q)
+		case "/invalid":
+			return JSON(make(chan int))
+		default:
+			return JSON(q)
+		}
+	}
+
+	in := []struct {
+		path        string
+		code        int
+		contentType string
+	}{
+		{"/quake", http.StatusOK, "application/json"},
+		{"/geojson", http.StatusOK, "application/vnd.geo+json"},
+		{"/invalid", http.StatusInternalServerError, ""},
+	}
+
+	for _, v := range in {
+		for _, method := range []string{"GET", "POST", "PUT"} {
+			w := httptest.NewRecorder()
+			MakeHandlerAPI(h).ServeHTTP(w, httptest.NewRequest(method, "http://test.com"+v.path, nil))
+
+			if w.Code != v.code {
+				t.Errorf("%s %s expected status %d got %d", method, v.path, v.code, w.Code)
+			}
+
+			if v.code != http.StatusOK {
+				continue
+			}
+
+			if w.Header().Get("Content-Type") != v.contentType {
+				t.Errorf("%s %s expected Content-Type %s got %s", method, v.path, v.contentType, w.Header().Get("Content-Type"))
+			}
+
+			var out quake
+			if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil {
+				t.Errorf("%s %s invalid JSON %s: %s", method, v.path, w.Body.String(), err)
+			}
+
+			if out != q {
+				t.Errorf("%s %s expected %+v got %+v", method, v.path, q, out)
+			}
+		}
+	}
+
+	// the Result from the handler is not changed when Data can't be encoded.
+	res := JSON(make(chan int))
+
+	WriteBytes(httptest.NewRecorder(), httptest.NewRequest("GET", "http://test.com", nil), res, &bytes.Buffer{}, false)
+	Write(httptest.NewRecorder(), httptest.NewRequest("PUT", "http://test.com", nil), res)
+
+	if !res.Ok || res.Code != http.StatusOK || res.Data == nil {
+		t.Errorf("expected the Result to be unchanged got %+v", res)
+	}
+
+	// a body written by the handler is not replaced.
+	written := func(r *http.Request, h http.Header, b *bytes.Buffer) *Result {
+		b.WriteString(`{"publicID":"2016p000001"}`)
+		return JSON(q)
+	}
+
+	w := httptest.NewRecorder()
+	MakeHandlerAPI(written).ServeHTTP(w, httptest.NewRequest("GET", "http://test.com", nil))
+
+	if w.Body.String() != `{"publicID":"2016p000001"}` {
+		t.Errorf("expected the handler body got %s", w.Body.String())
+	}
+}
@@ -0,0 +1,50 @@
+package weft
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+)
+
+/*
+StatusLogger is called by MakeHandlerPage and MakeHandlerAPI for responses that are not 2xx
+or http.StatusNotModified.  class is the status class of code e.g., 4 for http.StatusNotFound
+and 5 for http.StatusInternalServerError so that the response can be logged at an appropriate
+level.  msg is Result.Msg.  Set to nil to disable logging.  Set during init.
+*/
+var StatusLogger = SlogStatusLogger(nil)
+
+/*
+SlogStatusLogger returns a StatusLogger that logs to l.  5xx responses are logged at
+slog.LevelError, 4xx at slog.LevelWarn and anything else at slog.LevelInfo.  If l is nil
+slog.Default() is used.
+*/
+func SlogStatusLogger(l *slog.Logger) func(r *http.Request, class, code int, msg string) {
+	return func(r *http.Request, class, code int, msg string) {
+		logger := l
+		if logger == nil {
+			logger = slog.Default()
+		}
+
+		level := slog.LevelInfo
+		switch class {
+		case 5:
+			level = slog.LevelError
+		case 4:
+			level = slog.LevelWarn
+		}
+
+		logger.Log(context.Background(), level, "status",
+			"code", code,
+			"uri", r.RequestURI,
+			"request_id", RequestID(r),
+			"error", msg)
+	}
+}
+
+// logStatus calls StatusLogger for res.
+func logStatus(r *http.Request, res *Result) {
+	if StatusLogger != nil {
+		StatusLogger(r, res.Code/100, res.Code, res.Msg)
+	}
+}
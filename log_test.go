@@ -0,0 +1,74 @@
+package weft
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestStatusLogger(t *testing.T) {
+	defer func() { StatusLogger = SlogStatusLogger(nil) }()
+
+	var buf bytes.Buffer
+	StatusLogger = SlogStatusLogger(slog.New(slog.NewTextHandler(&buf, nil)))
+
+	in := []struct {
+		res   *Result
+		level string
+	}{
+		{&NotFound, "level=WARN"},
+		{BadRequest("bad"), "level=WARN"},
+		{InternalServerError(errors.New("broken")), "level=ERROR"},
+		{ServiceUnavailableError(errors.New("busy")), "level=ERROR"},
+		{&StatusOK, ""},
+	}
+
+	for _, v := range in {
+		res := v.res
+		h := func(r *http.Request, h http.Header, b *bytes.Buffer) *Result {
+			return res
+		}
+
+		buf.Reset()
+
+		r := httptest.NewRequest("GET", "http://test.com/quake", nil)
+		r.Header.Set("X-Request-Id", "abc")
+
+		MakeHandlerAPI(h).ServeHTTP(httptest.NewRecorder(), r)
+
+		switch v.level {
+		case "":
+			if buf.Len() != 0 {
+				t.Errorf("%d expected no log got %s", res.Code, buf.String())
+			}
+		default:
+			l := buf.String()
+			if !strings.Contains(l, v.level) {
+				t.Errorf("%d expected %s got %s", res.Code, v.level, l)
+			}
+			if !strings.Contains(l, "request_id=abc") {
+				t.Errorf("%d expected request_id=abc got %s", res.Code, l)
+			}
+		}
+	}
+
+	// classes are passed to custom loggers.
+	var class int
+	StatusLogger = func(r *http.Request, c, code int, msg string) {
+		class = c
+	}
+
+	h := func(r *http.Request, h http.Header, b *bytes.Buffer) *Result {
+		return &NotFound
+	}
+
+	MakeHandlerPage(h).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://test.com/quake", nil))
+
+	if class != 4 {
+		t.Errorf("expected class 4 got %d", class)
+	}
+}
@@ -0,0 +1,126 @@
+package weft
+
+import (
+	"bytes"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// BotPattern matches the User-Agent of crawlers for IsBot and Crawler.  Change during init.
+var BotPattern = regexp.MustCompile(`(?i)bot|crawler|spider|slurp|facebookexternalhit`)
+
+/*
+Deprecated wraps h and adds Deprecation and Sunset headers to the response
+to warn clients that the endpoint will be removed at sunset.  If link is not
+empty it is added as a Link header with rel="deprecation" e.g., to a page
+describing the replacement.
+
+The response from h is otherwise served normally.
+*/
+func Deprecated(sunset time.Time, link string, h RequestHandler) RequestHandler {
+	s := sunset.UTC().Format(http.TimeFormat)
+
+	return func(r *http.Request, header http.Header, b *bytes.Buffer) *Result {
+		header.Set("Deprecation", "true")
+		header.Set("Sunset", s)
+		if link != "" {
+			header.Add("Link", "<"+link+`>; rel="deprecation"`)
+		}
+
+		return h(r, header, b)
+	}
+}
+
+// IsBot returns true if the User-Agent of r matches BotPattern.
+func IsBot(r *http.Request) bool {
+	return BotPattern.MatchString(r.Header.Get("User-Agent"))
+}
+
+/*
+Crawler returns a RequestHandler that calls bot for requests from crawlers (see IsBot)
+e.g., to serve pre-rendered pages, and h for all other requests.
+
+Vary: User-Agent is added to the responses from both handlers so that caches
+don't serve one variant in place of the other.
+*/
+func Crawler(bot, h RequestHandler) RequestHandler {
+	return func(r *http.Request, header http.Header, b *bytes.Buffer) *Result {
+		AddVary(header, "User-Agent")
+
+		if IsBot(r) {
+			return bot(r, header, b)
+		}
+
+		return h(r, header, b)
+	}
+}
+
+// MaxPathLength wraps h and returns http.StatusRequestURITooLong, without calling h,
+// for requests with a URL path longer than n bytes.
+func MaxPathLength(n int, h RequestHandler) RequestHandler {
+	return func(r *http.Request, header http.Header, b *bytes.Buffer) *Result {
+		if len(r.URL.Path) > n {
+			return &Result{Ok: false, Code: http.StatusRequestURITooLong, Msg: "uri too long"}
+		}
+
+		return h(r, header, b)
+	}
+}
+
+// overrideMethods are the methods that MethodOverride allows a POST to be changed to.
+var overrideMethods = map[string]bool{
+	"PUT":    true,
+	"PATCH":  true,
+	"DELETE": true,
+}
+
+/*
+MethodOverride wraps h for clients that can only make GET and POST requests.  For POST
+requests the method is changed to the value of the X-HTTP-Method-Override header or, if the
+header is not set, the _method query parameter or form field.  Only PUT, PATCH, and DELETE
+are allowed.  Other values, and overrides on any method other than POST, are ignored.
+When the override is used the _method query parameter is removed so that it is not rejected
+by CheckQuery.  h is called with a copy of the request, r is not changed.
+
+It is an http.Handler as the method must be changed before MakeHandlerAPI e.g.,
+
+	http.Handle("/quake", weft.MethodOverride(weft.MakeHandlerAPI(quakeHandler)))
+*/
+func MethodOverride(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			m := r.Header.Get("X-HTTP-Method-Override")
+			if m == "" {
+				m = r.URL.Query().Get("_method")
+			}
+			if m == "" && strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+				m = r.PostFormValue("_method")
+			}
+
+			m = strings.ToUpper(strings.TrimSpace(m))
+			if overrideMethods[m] {
+				r = overrideMethod(r, m)
+			}
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// overrideMethod returns a shallow copy of r with the method m and without the _method query parameter.
+func overrideMethod(r *http.Request, m string) *http.Request {
+	o := *r
+	o.Method = m
+
+	u := *r.URL
+	q := u.Query()
+	if _, ok := q["_method"]; ok {
+		q.Del("_method")
+		u.RawQuery = q.Encode()
+	}
+	o.URL = &u
+
+	return &o
+}
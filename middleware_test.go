@@ -0,0 +1,216 @@
+package weft
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeprecated(t *testing.T) {
+	r, err := http.NewRequest("GET", "http://test.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := func(r *http.Request, h http.Header, b *bytes.Buffer) *Result {
+		h.Set("Content-Type", "text/plain")
+		b.WriteString("still served")
+		return &StatusOK
+	}
+
+	sunset := time.Date(2017, time.January, 2, 3, 4, 5, 0, time.UTC)
+
+	w := httptest.NewRecorder()
+	MakeHandlerAPI(Deprecated(sunset, "https://api.geonet.org.nz/v2", h)).ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status %d got %d", http.StatusOK, w.Code)
+	}
+
+	if w.Body.String() != "still served" {
+		t.Errorf("expected body still served got %s", w.Body.String())
+	}
+
+	if w.Header().Get("Deprecation") != "true" {
+		t.Errorf("expected Deprecation true got %s", w.Header().Get("Deprecation"))
+	}
+
+	if w.Header().Get("Sunset") != "Mon, 02 Jan 2017 03:04:05 GMT" {
+		t.Errorf("expected Sunset Mon, 02 Jan 2017 03:04:05 GMT got %s", w.Header().Get("Sunset"))
+	}
+
+	if w.Header().Get("Link") != `<https://api.geonet.org.nz/v2>; rel="deprecation"` {
+		t.Errorf("wrong Link header %s", w.Header().Get("Link"))
+	}
+
+	// no link
+	w = httptest.NewRecorder()
+	MakeHandlerAPI(Deprecated(sunset, "", h)).ServeHTTP(w, r)
+
+	if w.Header().Get("Sunset") != "Mon, 02 Jan 2017 03:04:05 GMT" {
+		t.Errorf("expected Sunset Mon, 02 Jan 2017 03:04:05 GMT got %s", w.Header().Get("Sunset"))
+	}
+
+	if _, ok := w.Header()["Link"]; ok {
+		t.Error("expected no Link header")
+	}
+}
+
+func TestCrawler(t *testing.T) {
+	bot := func(r *http.Request, h http.Header, b *bytes.Buffer) *Result {
+		h.Set("Content-Type", "text/html; charset=utf-8")
+		b.WriteString("<html>pre-rendered</html>")
+		return &StatusOK
+	}
+
+	h := func(r *http.Request, h http.Header, b *bytes.Buffer) *Result {
+		h.Set("Content-Type", "text/html; charset=utf-8")
+		b.WriteString("<html>app</html>")
+		return &StatusOK
+	}
+
+	in := []struct {
+		userAgent string
+		body      string
+	}{
+		{"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)", "<html>pre-rendered</html>"},
+		{"Mozilla/5.0 (compatible; bingbot/2.0; +http://www.bing.com/bingbot.htm)", "<html>pre-rendered</html>"},
+		{"Mozilla/5.0 (X11; Linux x86_64; rv:45.0) Gecko/20100101 Firefox/45.0", "<html>app</html>"},
+		{"", "<html>app</html>"},
+	}
+
+	for _, v := range in {
+		r, err := http.NewRequest("GET", "http://test.com", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("User-Agent", v.userAgent)
+
+		w := httptest.NewRecorder()
+		MakeHandlerPage(Crawler(bot, h)).ServeHTTP(w, r)
+
+		if w.Body.String() != v.body {
+			t.Errorf("%s expected body %s got %s", v.userAgent, v.body, w.Body.String())
+		}
+
+		if w.Header().Get("Vary") != "User-Agent, Accept-Encoding" {
+			t.Errorf("%s expected Vary User-Agent, Accept-Encoding got %v", v.userAgent, w.Header()["Vary"])
+		}
+	}
+}
+
+func TestMaxPathLength(t *testing.T) {
+	var calls int
+
+	h := func(r *http.Request, h http.Header, b *bytes.Buffer) *Result {
+		calls++
+		return &StatusOK
+	}
+
+	in := []struct {
+		path string
+		code int
+	}{
+		{"/quake", http.StatusOK},
+		{"/quake/2016", http.StatusOK},
+		{"/quake/2016p", http.StatusRequestURITooLong},
+	}
+
+	for _, v := range in {
+		r, err := http.NewRequest("GET", "http://test.com"+v.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		calls = 0
+
+		w := httptest.NewRecorder()
+		MakeHandlerAPI(MaxPathLength(11, h)).ServeHTTP(w, r)
+
+		if w.Code != v.code {
+			t.Errorf("%s expected code %d got %d", v.path, v.code, w.Code)
+		}
+
+		if v.code != http.StatusOK && calls != 0 {
+			t.Errorf("%s expected handler not to be called", v.path)
+		}
+
+		if v.code == http.StatusRequestURITooLong && w.Header().Get("Surrogate-Control") != "max-age=86400" {
+			t.Errorf("%s expected Surrogate-Control max-age=86400 got %s", v.path, w.Header().Get("Surrogate-Control"))
+		}
+	}
+}
+
+func TestMethodOverride(t *testing.T) {
+	var method string
+
+	h := MethodOverride(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method = r.Method
+	}))
+
+	in := []struct {
+		method   string
+		header   string
+		query    string
+		form     string
+		expected string
+	}{
+		{"POST", "DELETE", "", "", "DELETE"},
+		{"POST", "put", "", "", "PUT"},
+		{"POST", "", "_method=PATCH", "", "PATCH"},
+		{"POST", "", "", "_method=DELETE", "DELETE"},
+		{"POST", "DELETE", "_method=PUT", "", "DELETE"},
+		{"POST", "CONNECT", "", "", "POST"},
+		{"POST", "GET", "", "", "POST"},
+		{"POST", "", "", "", "POST"},
+		{"GET", "DELETE", "", "", "GET"},
+		{"GET", "", "_method=DELETE", "", "GET"},
+		{"PUT", "DELETE", "", "", "PUT"},
+	}
+
+	for _, v := range in {
+		u := "http://test.com/quake"
+		if v.query != "" {
+			u += "?" + v.query
+		}
+
+		r := httptest.NewRequest(v.method, u, strings.NewReader(v.form))
+		if v.header != "" {
+			r.Header.Set("X-HTTP-Method-Override", v.header)
+		}
+		if v.form != "" {
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+
+		method = ""
+		h.ServeHTTP(httptest.NewRecorder(), r)
+
+		if method != v.expected {
+			t.Errorf("%s override %s%s%s expected method %s got %s", v.method, v.header, v.query, v.form, v.expected, method)
+		}
+
+		if r.Method != v.method {
+			t.Errorf("%s override %s%s%s changed the caller's request to %s", v.method, v.header, v.query, v.form, r.Method)
+		}
+	}
+
+	// _method is removed from the query so that CheckQuery doesn't reject it.
+	api := MethodOverride(MakeHandlerAPI(func(r *http.Request, h http.Header, b *bytes.Buffer) *Result {
+		if res := CheckQuery(r, []string{"id"}, []string{}); !res.Ok {
+			return res
+		}
+		method = r.Method
+		return &StatusOK
+	}))
+
+	method = ""
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("POST", "http://test.com/quake?_method=DELETE&id=1", nil))
+
+	if w.Code != http.StatusOK || method != "DELETE" {
+		t.Errorf("expected status %d and method DELETE got %d and %s: %s", http.StatusOK, w.Code, method, w.Body.String())
+	}
+}
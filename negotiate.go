@@ -0,0 +1,280 @@
+package weft
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+/*
+AddVary adds fields to the Vary header in h.  All Vary values in h are combined
+into a single header with duplicates removed e.g., handlers that vary the response
+on the User-Agent should add it:
+
+	weft.AddVary(h, "User-Agent")
+
+Negotiate adds Accept, NegotiateLanguage adds Accept-Language, and WriteBytes adds
+Accept-Encoding.  The Vary header is not set if there are no fields.
+*/
+func AddVary(h http.Header, fields ...string) {
+	var v []string
+	seen := make(map[string]bool)
+
+	for _, s := range append(h["Vary"], fields...) {
+		for _, f := range strings.Split(s, ",") {
+			f = strings.TrimSpace(f)
+			k := strings.ToLower(f)
+
+			if f == "" || seen[k] {
+				continue
+			}
+
+			seen[k] = true
+			v = append(v, f)
+		}
+	}
+
+	if len(v) == 0 {
+		return
+	}
+
+	h.Set("Vary", strings.Join(v, ", "))
+}
+
+// acceptValue is a value and its quality from an Accept style header.
+type acceptValue struct {
+	value string
+	q     float64
+}
+
+// parseAccept parses an Accept style header e.g., "text/html;q=0.8, application/json".
+// Values are lower cased.  Parameters other than q are ignored.  Values with an
+// invalid q are skipped.
+func parseAccept(header string) []acceptValue {
+	var a []acceptValue
+
+	for _, s := range strings.Split(header, ",") {
+		p := strings.Split(s, ";")
+
+		v := strings.ToLower(strings.TrimSpace(p[0]))
+		if v == "" {
+			continue
+		}
+
+		q := 1.0
+
+		for _, param := range p[1:] {
+			param = strings.TrimSpace(param)
+			if len(param) > 2 && strings.EqualFold(param[:2], "q=") {
+				f, err := strconv.ParseFloat(param[2:], 64)
+				if err != nil || f < 0 || f > 1 {
+					q = -1
+				} else {
+					q = f
+				}
+			}
+		}
+
+		if q < 0 {
+			continue
+		}
+
+		a = append(a, acceptValue{value: v, q: q})
+	}
+
+	return a
+}
+
+// acceptsEncoding returns true if the Accept-Encoding header of r accepts encoding.
+func acceptsEncoding(r *http.Request, encoding string) bool {
+	h := r.Header.Get("Accept-Encoding")
+	if h == "" {
+		return false
+	}
+
+	q := 0.0
+
+	for _, a := range parseAccept(h) {
+		switch a.value {
+		case encoding:
+			return a.q > 0
+		case "*":
+			q = a.q
+		}
+	}
+
+	return q > 0
+}
+
+// specificity returns how well the media range a matches the media type t.
+// 2 for an exact match, 1 for a subtype wildcard, 0 for */* and -1 for no match.
+func specificity(a, t string) int {
+	switch {
+	case a == t:
+		return 2
+	case a == "*/*":
+		return 0
+	case strings.HasSuffix(a, "/*") && strings.HasPrefix(t, a[:len(a)-1]):
+		return 1
+	}
+
+	return -1
+}
+
+// Negotiate returns the offer that best matches the Accept header of r.  Accept is added
+// to Vary in h so that caches store each media type separately.
+// Offers are media types e.g., "application/json".
+//
+// Each offer takes the q value of the most specific media range that matches it,
+// per RFC 7231 an exact type is more specific than a subtype wildcard (application/*)
+// which is more specific than */*.  The offer with the highest q value wins.  Ties
+// are resolved by specificity and then by the order of offers.
+//
+// The first offer is returned if r has no Accept header.  NotAcceptable is returned
+// if none of the offers are acceptable.
+func Negotiate(r *http.Request, h http.Header, offers []string) (string, *Result) {
+	if len(offers) == 0 {
+		return "", &NotAcceptable
+	}
+
+	AddVary(h, "Accept")
+
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return offers[0], &StatusOK
+	}
+
+	ranges := parseAccept(accept)
+
+	best := -1
+	bestQ := 0.0
+	bestS := -1
+
+	for i, o := range offers {
+		t := strings.ToLower(strings.TrimSpace(strings.Split(o, ";")[0]))
+
+		q := 0.0
+		s := -1
+
+		for _, a := range ranges {
+			switch m := specificity(a.value, t); {
+			case m > s:
+				s = m
+				q = a.q
+			case m == s && a.q > q:
+				q = a.q
+			}
+		}
+
+		if s < 0 || q == 0 {
+			continue
+		}
+
+		if q > bestQ || (q == bestQ && s > bestS) {
+			best = i
+			bestQ = q
+			bestS = s
+		}
+	}
+
+	if best < 0 {
+		return "", &NotAcceptable
+	}
+
+	return offers[best], &StatusOK
+}
+
+/*
+CheckAcceptCharset returns http.StatusNotAcceptable if the Accept-Charset header of r
+explicitly excludes UTF-8, the only charset weft serves e.g.,
+
+	Accept-Charset: iso-8859-1;q=1, utf-8;q=0
+
+UTF-8 is acceptable when there is no Accept-Charset header or it is not listed.  Many clients
+are lenient about charsets so calling CheckAcceptCharset is opt in for strict handlers.
+*/
+func CheckAcceptCharset(r *http.Request) *Result {
+	h := r.Header.Get("Accept-Charset")
+	if h == "" {
+		return &StatusOK
+	}
+
+	q := 1.0
+
+	for _, a := range parseAccept(h) {
+		switch a.value {
+		case "utf-8":
+			if a.q == 0 {
+				return &Result{Ok: false, Code: http.StatusNotAcceptable, Msg: "charset utf-8 not acceptable"}
+			}
+			return &StatusOK
+		case "*":
+			q = a.q
+		}
+	}
+
+	if q == 0 {
+		return &Result{Ok: false, Code: http.StatusNotAcceptable, Msg: "charset utf-8 not acceptable"}
+	}
+
+	return &StatusOK
+}
+
+/*
+NegotiateLanguage returns the offer that best matches the Accept-Language header of r and sets
+it in the Content-Language header of h.  Accept-Language is added to Vary in h so that caches
+store each language separately.  Offers are language tags e.g., "en-NZ", "mi".
+
+A language range matches a tag that is the same or that starts with the range followed by
+a hyphen e.g., en matches en-NZ.  Each offer takes the q value of the longest range that
+matches it and * matches any offer.  The offer with the highest q value wins.  Ties are
+resolved by the order of offers.
+
+The first offer is returned when r has no Accept-Language header or none of the offers are
+acceptable, as serving a default language is better than http.StatusNotAcceptable.
+An empty string is returned, and no headers are set, when there are no offers.
+*/
+func NegotiateLanguage(r *http.Request, h http.Header, offers []string) string {
+	if len(offers) == 0 {
+		return ""
+	}
+
+	AddVary(h, "Accept-Language")
+
+	ranges := parseAccept(r.Header.Get("Accept-Language"))
+
+	best := 0
+	bestQ := 0.0
+
+	for i, o := range offers {
+		t := strings.ToLower(o)
+
+		q := 0.0
+		l := -1
+
+		for _, a := range ranges {
+			m := -1
+
+			switch {
+			case a.value == "*":
+				m = 0
+			case a.value == t, strings.HasPrefix(t, a.value+"-"):
+				m = len(a.value)
+			}
+
+			if m > l {
+				l = m
+				q = a.q
+			}
+		}
+
+		if q > bestQ {
+			best = i
+			bestQ = q
+		}
+	}
+
+	h.Set("Content-Language", offers[best])
+
+	return offers[best]
+}
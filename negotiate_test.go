@@ -0,0 +1,242 @@
+package weft
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	in := []struct {
+		accept   string
+		offers   []string
+		expected string
+		ok       bool
+	}{
+		{"", []string{"application/json", "text/csv"}, "application/json", true},
+		{"*/*", []string{"application/json", "text/csv"}, "application/json", true},
+		{"text/csv", []string{"application/json", "text/csv"}, "text/csv", true},
+		{"text/html", []string{"application/json", "text/csv"}, "", false},
+		// q values.
+		{"application/json;q=0.5, text/csv", []string{"application/json", "text/csv"}, "text/csv", true},
+		{"text/csv;q=0, */*", []string{"text/csv", "application/json"}, "application/json", true},
+		// ties are resolved by specificity.
+		{"application/*;q=0.5, application/json;q=0.5", []string{"application/xml", "application/json"}, "application/json", true},
+		{"*/*;q=0.5, application/*;q=0.5", []string{"text/csv", "application/json"}, "application/json", true},
+		// the most specific range sets the q value for an offer.
+		{"application/*;q=0.9, application/json;q=0.1", []string{"application/json", "application/xml"}, "application/xml", true},
+		// wildcard fallbacks.
+		{"application/*", []string{"text/csv", "application/json"}, "application/json", true},
+		{"text/html, */*;q=0.1", []string{"text/csv", "application/json"}, "text/csv", true},
+		{"APPLICATION/JSON", []string{"application/json"}, "application/json", true},
+	}
+
+	for _, v := range in {
+		r, err := http.NewRequest("GET", "http://test.com", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if v.accept != "" {
+			r.Header.Set("Accept", v.accept)
+		}
+
+		h := http.Header{}
+		o, res := Negotiate(r, h, v.offers)
+
+		if h.Get("Vary") != "Accept" {
+			t.Errorf("Accept: %s expected Vary Accept got %s", v.accept, h.Get("Vary"))
+		}
+
+		if res.Ok != v.ok {
+			t.Errorf("Accept: %s expected ok %t got %t", v.accept, v.ok, res.Ok)
+		}
+
+		if !res.Ok && res.Code != http.StatusNotAcceptable {
+			t.Errorf("Accept: %s expected code %d got %d", v.accept, http.StatusNotAcceptable, res.Code)
+		}
+
+		if o != v.expected {
+			t.Errorf("Accept: %s expected %s got %s", v.accept, v.expected, o)
+		}
+	}
+}
+
+func TestCheckAcceptCharset(t *testing.T) {
+	in := []struct {
+		acceptCharset string
+		ok            bool
+	}{
+		{"", true},
+		{"utf-8", true},
+		{"UTF-8;q=0.5, iso-8859-1", true},
+		{"iso-8859-1", true},
+		{"iso-8859-1, *;q=0.1", true},
+		{"iso-8859-1;q=1, utf-8;q=0", false},
+		{"iso-8859-1, *;q=0", false},
+		{"utf-8;q=0.1, *;q=0", true},
+	}
+
+	for _, v := range in {
+		r, err := http.NewRequest("GET", "http://test.com", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if v.acceptCharset != "" {
+			r.Header.Set("Accept-Charset", v.acceptCharset)
+		}
+
+		res := CheckAcceptCharset(r)
+
+		if res.Ok != v.ok {
+			t.Errorf("Accept-Charset: %s expected ok %t got %t", v.acceptCharset, v.ok, res.Ok)
+		}
+
+		if !res.Ok && res.Code != http.StatusNotAcceptable {
+			t.Errorf("Accept-Charset: %s expected code %d got %d", v.acceptCharset, http.StatusNotAcceptable, res.Code)
+		}
+	}
+}
+
+func TestAddVary(t *testing.T) {
+	in := []struct {
+		existing []string
+		fields   []string
+		expected string
+	}{
+		{nil, []string{"Accept-Encoding"}, "Accept-Encoding"},
+		{nil, []string{"Accept", "Accept-Encoding"}, "Accept, Accept-Encoding"},
+		{[]string{"Accept"}, []string{"Accept-Encoding"}, "Accept, Accept-Encoding"},
+		{[]string{"Accept", "User-Agent"}, []string{"Accept-Language", "Accept-Encoding"}, "Accept, User-Agent, Accept-Language, Accept-Encoding"},
+		{[]string{"Accept, Accept-Language"}, []string{"accept", "Accept-Encoding"}, "Accept, Accept-Language, Accept-Encoding"},
+		{[]string{"Accept-Encoding"}, []string{"Accept-Encoding"}, "Accept-Encoding"},
+		{[]string{"Accept"}, nil, "Accept"},
+	}
+
+	for _, v := range in {
+		h := http.Header{}
+		for _, e := range v.existing {
+			h.Add("Vary", e)
+		}
+
+		AddVary(h, v.fields...)
+
+		if len(h["Vary"]) != 1 {
+			t.Errorf("expected a single Vary header got %v", h["Vary"])
+		}
+
+		if h.Get("Vary") != v.expected {
+			t.Errorf("expected Vary %s got %s", v.expected, h.Get("Vary"))
+		}
+	}
+
+	// negotiation dimensions used by the handler and WriteBytes are combined.
+	r, err := http.NewRequest("GET", "http://test.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Accept", "application/json")
+
+	f := func(r *http.Request, h http.Header, b *bytes.Buffer) *Result {
+		c, res := Negotiate(r, h, []string{"application/json", "text/csv"})
+		h.Add("Vary", "Accept-Encoding")
+		h.Set("Content-Type", c)
+		return res
+	}
+
+	w := httptest.NewRecorder()
+	MakeHandlerAPI(Crawler(f, f)).ServeHTTP(w, r)
+
+	if len(w.Header()["Vary"]) != 1 || w.Header().Get("Vary") != "User-Agent, Accept, Accept-Encoding" {
+		t.Errorf("expected Vary User-Agent, Accept, Accept-Encoding got %v", w.Header()["Vary"])
+	}
+}
+
+func TestAddVaryEmpty(t *testing.T) {
+	h := http.Header{}
+	AddVary(h)
+
+	if _, ok := h["Vary"]; ok {
+		t.Errorf("expected no Vary header got %v", h["Vary"])
+	}
+}
+
+func TestNegotiateLanguage(t *testing.T) {
+	offers := []string{"en-NZ", "mi", "en-US"}
+
+	in := []struct {
+		acceptLanguage string
+		expected       string
+	}{
+		{"", "en-NZ"},
+		{"mi", "mi"},
+		{"MI", "mi"},
+		{"en-US", "en-US"},
+		{"en", "en-NZ"},
+		{"fr, mi;q=0.8", "mi"},
+		{"en;q=0.5, mi;q=0.8", "mi"},
+		{"en-US;q=0.9, en;q=0.5", "en-US"},
+		{"*;q=0.5, mi;q=0.1", "en-NZ"},
+		{"en-NZ;q=0, *", "mi"},
+		{"fr", "en-NZ"},
+		{"m", "en-NZ"},
+	}
+
+	for _, v := range in {
+		r := httptest.NewRequest("GET", "http://test.com", nil)
+		if v.acceptLanguage != "" {
+			r.Header.Set("Accept-Language", v.acceptLanguage)
+		}
+
+		h := http.Header{}
+
+		if l := NegotiateLanguage(r, h, offers); l != v.expected {
+			t.Errorf("%s expected %s got %s", v.acceptLanguage, v.expected, l)
+		}
+
+		if h.Get("Content-Language") != v.expected {
+			t.Errorf("%s expected Content-Language %s got %s", v.acceptLanguage, v.expected, h.Get("Content-Language"))
+		}
+
+		if h.Get("Vary") != "Accept-Language" {
+			t.Errorf("%s expected Vary Accept-Language got %s", v.acceptLanguage, h.Get("Vary"))
+		}
+	}
+
+	// no offers
+	h := http.Header{}
+	if l := NegotiateLanguage(httptest.NewRequest("GET", "http://test.com", nil), h, nil); l != "" || len(h) != 0 {
+		t.Errorf("expected no language or headers got %s %v", l, h)
+	}
+
+	// written to the client
+	f := func(r *http.Request, h http.Header, b *bytes.Buffer) *Result {
+		switch NegotiateLanguage(r, h, offers) {
+		case "mi":
+			b.WriteString("Kia ora")
+		default:
+			b.WriteString("Hello")
+		}
+		return &StatusOK
+	}
+
+	r := httptest.NewRequest("GET", "http://test.com", nil)
+	r.Header.Set("Accept-Language", "mi, en;q=0.5")
+
+	w := httptest.NewRecorder()
+	MakeHandlerAPI(f).ServeHTTP(w, r)
+
+	if w.Body.String() != "Kia ora" {
+		t.Errorf("expected body Kia ora got %s", w.Body.String())
+	}
+
+	if w.Header().Get("Content-Language") != "mi" {
+		t.Errorf("expected Content-Language mi got %s", w.Header().Get("Content-Language"))
+	}
+
+	if w.Header().Get("Vary") != "Accept-Language, Accept-Encoding" {
+		t.Errorf("expected Vary Accept-Language, Accept-Encoding got %s", w.Header().Get("Vary"))
+	}
+}
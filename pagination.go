@@ -0,0 +1,106 @@
+package weft
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+)
+
+/*
+EncodeCursor returns an opaque cursor for the position v in a paginated result e.g.,
+a struct holding the sort key of the last item in the page.  v is encoded as JSON
+in URL safe base64 so the cursor can be used in a query parameter.
+*/
+func EncodeCursor(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+/*
+DecodeCursor decodes the cursor in query parameter name from r into the value pointed to by v.
+If the parameter is not present v is unchanged e.g., for the first page.  BadRequest is returned
+if the cursor can't be decoded.
+*/
+func DecodeCursor(r *http.Request, name string, v interface{}) *Result {
+	s := r.URL.Query().Get(name)
+	if s == "" {
+		return &StatusOK
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return BadRequest("invalid cursor for parameter: " + name)
+	}
+
+	if err := json.Unmarshal(b, v); err != nil {
+		return BadRequest("invalid cursor for parameter: " + name)
+	}
+
+	return &StatusOK
+}
+
+/*
+SetNextCursor encodes next with EncodeCursor and sets it in the X-Next-Cursor header of h.
+It returns the cursor so that it can also be included in the response body.  A nil next
+means there are no more pages.  The header is removed and an empty cursor is returned.
+*/
+func SetNextCursor(h http.Header, next interface{}) (string, error) {
+	if next == nil {
+		h.Del("X-Next-Cursor")
+		return "", nil
+	}
+
+	c, err := EncodeCursor(next)
+	if err != nil {
+		return "", err
+	}
+
+	h.Set("X-Next-Cursor", c)
+
+	return c, nil
+}
+
+type pageMeta struct {
+	Total  int `json:"total"`
+	Limit  int `json:"limit"`
+	Offset int `json:"offset"`
+}
+
+type page struct {
+	Meta pageMeta        `json:"meta"`
+	Data json.RawMessage `json:"data"`
+}
+
+/*
+PagedResponse returns data as JSON in the standard envelope for a page of a list e.g.,
+
+	{"meta":{"total":120,"limit":20,"offset":40},"data":[...]}
+
+total is the number of items in the whole list.  A nil data, or nil slice, is returned
+as an empty array.  Write the result to b in a RequestHandler e.g.,
+
+	p, err := weft.PagedResponse(quakes, total, limit, offset)
+	if err != nil {
+		return weft.InternalServerError(err)
+	}
+	b.Write(p)
+*/
+func PagedResponse(data interface{}, total, limit, offset int) ([]byte, error) {
+	d, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if string(d) == "null" {
+		d = []byte("[]")
+	}
+
+	return json.Marshal(page{
+		Meta: pageMeta{Total: total, Limit: limit, Offset: offset},
+		Data: json.RawMessage(d),
+	})
+}
@@ -0,0 +1,143 @@
+package weft
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type testCursor struct {
+	Time     string `json:"t"`
+	PublicID string `json:"id"`
+}
+
+func TestCursor(t *testing.T) {
+	quakes := []string{"2016p000001", "2016p000002", "2016p000003", "2016p000004", "2016p000005"}
+
+	// returns pages of two quakes after the cursor.
+	h := func(r *http.Request, h http.Header, b *bytes.Buffer) *Result {
+		var c testCursor
+		if res := DecodeCursor(r, "cursor", &c); !res.Ok {
+			return res
+		}
+
+		var start int
+		for i, q := range quakes {
+			if q == c.PublicID {
+				start = i + 1
+			}
+		}
+
+		end := start + 2
+		if end > len(quakes) {
+			end = len(quakes)
+		}
+
+		var next interface{}
+		if end < len(quakes) {
+			next = testCursor{PublicID: quakes[end-1]}
+		}
+
+		n, err := SetNextCursor(h, next)
+		if err != nil {
+			return InternalServerError(err)
+		}
+
+		json.NewEncoder(b).Encode(struct {
+			Quakes []string `json:"quakes"`
+			Next   string   `json:"next,omitempty"`
+		}{quakes[start:end], n})
+
+		return &StatusOK
+	}
+
+	var pages [][]string
+	var cursor string
+
+	for i := 0; i < 5; i++ {
+		u := "http://test.com/quakes"
+		if cursor != "" {
+			u += "?cursor=" + cursor
+		}
+
+		w := httptest.NewRecorder()
+		MakeHandlerAPI(h).ServeHTTP(w, httptest.NewRequest("GET", u, nil))
+
+		var p struct {
+			Quakes []string
+			Next   string
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil {
+			t.Fatal(err)
+		}
+
+		pages = append(pages, p.Quakes)
+
+		c, ok := w.Header()["X-Next-Cursor"]
+
+		if len(pages) < 3 {
+			// middle page
+			if !ok || c[0] == "" || c[0] != p.Next {
+				t.Errorf("page %d expected X-Next-Cursor matching the body got %v body %s", len(pages), c, p.Next)
+			}
+		} else {
+			// last page
+			if ok {
+				t.Errorf("page %d expected no X-Next-Cursor got %v", len(pages), c)
+			}
+			break
+		}
+
+		cursor = c[0]
+	}
+
+	if len(pages) != 3 || pages[2][0] != "2016p000005" {
+		t.Errorf("expected 3 pages ending with 2016p000005 got %v", pages)
+	}
+
+	// invalid cursors
+	for _, c := range []string{"!!!", "bm90IGpzb24"} {
+		w := httptest.NewRecorder()
+		MakeHandlerAPI(h).ServeHTTP(w, httptest.NewRequest("GET", "http://test.com/quakes?cursor="+c, nil))
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s expected status %d got %d", c, http.StatusBadRequest, w.Code)
+		}
+	}
+}
+
+func TestPagedResponse(t *testing.T) {
+	var none []string
+
+	in := []struct {
+		id       string
+		data     interface{}
+		total    int
+		limit    int
+		offset   int
+		expected string
+	}{
+		{"page", []string{"2016p000003", "2016p000004"}, 5, 2, 2, `{"meta":{"total":5,"limit":2,"offset":2},"data":["2016p000003","2016p000004"]}`},
+		{"empty", []string{}, 0, 20, 0, `{"meta":{"total":0,"limit":20,"offset":0},"data":[]}`},
+		{"nil slice", none, 0, 20, 0, `{"meta":{"total":0,"limit":20,"offset":0},"data":[]}`},
+		{"nil", nil, 0, 20, 0, `{"meta":{"total":0,"limit":20,"offset":0},"data":[]}`},
+	}
+
+	for _, v := range in {
+		b, err := PagedResponse(v.data, v.total, v.limit, v.offset)
+		if err != nil {
+			t.Errorf("%s unexpected error %s", v.id, err)
+			continue
+		}
+
+		if string(b) != v.expected {
+			t.Errorf("%s expected %s got %s", v.id, v.expected, b)
+		}
+	}
+
+	if _, err := PagedResponse(make(chan int), 0, 0, 0); err == nil {
+		t.Error("expected error for data that can't be encoded")
+	}
+}
@@ -0,0 +1,515 @@
+package weft
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+var timeType = reflect.TypeOf(time.Time{})
+
+/*
+BindQuery populates the fields of the struct pointed to by dst from the query
+parameters in r.  Fields are bound using the query struct tag e.g.,
+
+	var q struct {
+		PublicID  string    `query:"publicID,required"`
+		MinMag    float64   `query:"minmag"`
+		Limit     int       `query:"limit"`
+		Felt      bool      `query:"felt"`
+		StartTime time.Time `query:"startTime"`
+	}
+
+	if res := weft.BindQuery(r, &q); !res.Ok {
+		return res
+	}
+
+Fields may be strings, ints, uints, floats, bools, or time.Time (parsed as RFC3339).
+Fields without a query tag or with a missing optional parameter are left unchanged.
+BadRequest is returned for missing required parameters or values that can't be converted.
+*/
+func BindQuery(r *http.Request, dst interface{}) *Result {
+	p := reflect.ValueOf(dst)
+	if p.Kind() != reflect.Ptr || p.Elem().Kind() != reflect.Struct {
+		return InternalServerError(errors.New("BindQuery requires a pointer to a struct"))
+	}
+
+	v := r.URL.Query()
+	s := p.Elem()
+	t := s.Type()
+
+	var missing []string
+
+	for i := 0; i < t.NumField(); i++ {
+		tag := t.Field(i).Tag.Get("query")
+		if tag == "" || !s.Field(i).CanSet() {
+			continue
+		}
+
+		opts := strings.Split(tag, ",")
+		name := opts[0]
+
+		val := v.Get(name)
+		if val == "" {
+			for _, o := range opts[1:] {
+				if o == "required" {
+					missing = append(missing, name)
+				}
+			}
+			continue
+		}
+
+		if err := setField(s.Field(i), val); err != nil {
+			if _, ok := err.(*strconv.NumError); ok || err == errBadTime {
+				return BadRequest("invalid value for query parameter: " + name)
+			}
+			return InternalServerError(err)
+		}
+	}
+
+	switch len(missing) {
+	case 0:
+	case 1:
+		return BadRequest("missing required query parameter: " + missing[0])
+	default:
+		return BadRequest("missing required query parameters: " + strings.Join(missing, ", "))
+	}
+
+	return &StatusOK
+}
+
+/*
+FormatParam validates the format query parameter in r against allowed which maps format
+names to content types e.g.,
+
+	format, contentType, res := weft.FormatParam(r, map[string]string{
+		"json": "application/json",
+		"csv":  "text/csv",
+		"xml":  "application/xml",
+	}, "json")
+
+When the format parameter is absent def is used.  BadRequest is returned for an unknown format.
+The caller should set the returned content type on the response.
+*/
+func FormatParam(r *http.Request, allowed map[string]string, def string) (format, contentType string, res *Result) {
+	format = r.URL.Query().Get("format")
+	if format == "" {
+		format = def
+	}
+
+	contentType, ok := allowed[format]
+	if !ok {
+		return "", "", BadRequest("unknown format: " + format)
+	}
+
+	return format, contentType, &StatusOK
+}
+
+/*
+CheckQueryFloat parses query parameter name from r as a number.  BadRequest is returned
+if the parameter is missing or not a finite number e.g., NaN or Inf.
+*/
+func CheckQueryFloat(r *http.Request, name string) (float64, *Result) {
+	s := r.URL.Query().Get(name)
+	if s == "" {
+		return 0, BadRequest("missing required query parameter: " + name)
+	}
+
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, BadRequest("invalid number for parameter: " + name)
+	}
+
+	return v, &StatusOK
+}
+
+/*
+CheckQueryRange parses query parameter name from r as a number and checks it is
+between min and max inclusive.  BadRequest is returned if the parameter is missing,
+not a number, or out of range.
+*/
+func CheckQueryRange(r *http.Request, name string, min, max float64) (float64, *Result) {
+	v, res := CheckQueryFloat(r, name)
+	if !res.Ok {
+		return 0, res
+	}
+
+	if v < min || v > max {
+		return 0, BadRequest("parameter " + name + " must be between " + strconv.FormatFloat(min, 'g', -1, 64) +
+			" and " + strconv.FormatFloat(max, 'g', -1, 64))
+	}
+
+	return v, &StatusOK
+}
+
+// Parameter describes a query parameter for CheckQueryValid.
+type Parameter struct {
+	Name       string
+	Required   bool
+	Pattern    string   // optional regular expression that values must match e.g., ^[A-Z]{3,5}$
+	Values     []string // optional allowed values e.g., csv, json, xml
+	IgnoreCase bool     // match Values case-insensitively e.g., JSON matches json
+	Multi      bool     // the parameter may repeat e.g., id=1&id=2
+	Example    string   // optional example value for documentation e.g., WEL
+}
+
+// Parameters are the query parameters for a request.
+type Parameters []Parameter
+
+/*
+ExampleURL returns an example request URL for path using the Example of each of p
+in order e.g., /quake?publicID=2016p123456&format=json for documentation.
+Parameters without an Example are omitted.
+*/
+func (p Parameters) ExampleURL(path string) string {
+	var q []string
+
+	for _, v := range p {
+		if v.Example != "" {
+			q = append(q, url.QueryEscape(v.Name)+"="+url.QueryEscape(v.Example))
+		}
+	}
+
+	if len(q) == 0 {
+		return path
+	}
+
+	return path + "?" + strings.Join(q, "&")
+}
+
+var (
+	patternsMu sync.Mutex
+	patterns   = map[string]*regexp.Regexp{}
+)
+
+// pattern returns the compiled regular expression for p.  Compiled expressions are cached.
+func pattern(p string) (*regexp.Regexp, error) {
+	patternsMu.Lock()
+	defer patternsMu.Unlock()
+
+	if re, ok := patterns[p]; ok {
+		return re, nil
+	}
+
+	re, err := regexp.Compile(p)
+	if err != nil {
+		return nil, err
+	}
+
+	patterns[p] = re
+
+	return re, nil
+}
+
+/*
+CheckQueryValid validates the query parameters in r against params the same as CheckQuery
+and also checks values against the Pattern and Values for parameters that have them.
+BadRequest is returned for a value that doesn't match or for a repeated parameter that
+is not Multi.  Patterns are compiled when first used and
+InternalServerError is returned if a Pattern is not a valid regular expression.
+
+For parameters with IgnoreCase values that match one of Values in a different case
+are replaced in r.URL with the declared value e.g., format=JSON becomes format=json,
+so that the handler reads the declared value.
+*/
+func CheckQueryValid(r *http.Request, params Parameters) *Result {
+	var required, optional []string
+
+	for _, p := range params {
+		if p.Required {
+			required = append(required, p.Name)
+		} else {
+			optional = append(optional, p.Name)
+		}
+	}
+
+	v, _, res := checkQuery(r, required, optional, nil)
+	if !res.Ok {
+		return res
+	}
+
+	var folded bool
+
+	for _, p := range params {
+		values, ok := v[p.Name]
+		if !ok {
+			continue
+		}
+
+		if len(values) > 1 && !p.Multi {
+			return BadRequest("parameter may not repeat: " + p.Name)
+		}
+
+		for i, s := range values {
+			if p.IgnoreCase {
+				if c, ok := fold(p.Values, s); ok && c != s {
+					values[i] = c
+					s = c
+					folded = true
+				}
+			}
+
+			if p.Pattern != "" {
+				re, err := pattern(p.Pattern)
+				if err != nil {
+					return InternalServerError(err)
+				}
+
+				if !re.MatchString(s) {
+					return BadRequest("invalid value for parameter: " + p.Name)
+				}
+			}
+
+			if len(p.Values) > 0 && !contains(p.Values, s) {
+				return BadRequest("unknown value for parameter: " + p.Name)
+			}
+		}
+	}
+
+	if folded {
+		q := r.URL.Query()
+		for _, p := range params {
+			if values, ok := v[p.Name]; ok && p.IgnoreCase {
+				q[p.Name] = values
+			}
+		}
+		r.URL.RawQuery = q.Encode()
+	}
+
+	return &StatusOK
+}
+
+// fold returns the value in list that matches s case-insensitively.
+func fold(list []string, s string) (string, bool) {
+	for _, l := range list {
+		if strings.EqualFold(l, s) {
+			return l, true
+		}
+	}
+
+	return "", false
+}
+
+/*
+HasFlag returns true if query parameter name is present in r without a value e.g., ?debug,
+or with a true value e.g., ?debug=true.  It returns false if the parameter is absent or
+has a false or invalid value.  See CheckQueryFlags.
+*/
+func HasFlag(r *http.Request, name string) bool {
+	v, ok := r.URL.Query()[name]
+	if !ok {
+		return false
+	}
+
+	if len(v) == 0 || v[0] == "" {
+		return true
+	}
+
+	b, err := strconv.ParseBool(v[0])
+
+	return err == nil && b
+}
+
+/*
+CheckExclusive returns BadRequest if query parameters from more than one of groups are
+present in r e.g., for a bounding box that can be given as bbox or as separate limits
+
+	weft.CheckExclusive(r, []string{"bbox"}, []string{"minlat", "maxlat", "minlon", "maxlon"})
+
+It only checks the groups.  Use CheckQuery to check for missing or unexpected parameters.
+*/
+func CheckExclusive(r *http.Request, groups ...[]string) *Result {
+	v := r.URL.Query()
+
+	var first string
+
+	for _, g := range groups {
+		for _, k := range g {
+			if _, ok := v[k]; !ok {
+				continue
+			}
+
+			if first == "" {
+				first = k
+				break
+			}
+
+			return BadRequest("parameters " + first + " and " + k + " can not be used together")
+		}
+	}
+
+	return &StatusOK
+}
+
+/*
+CheckQueryDependent returns BadRequest if query parameter ifPresent is set in r and any of
+thenRequired are not e.g., endtime is required when starttime is set
+
+	weft.CheckQueryDependent(r, "starttime", "endtime")
+
+When ifPresent is not set thenRequired are not checked.  List them as optional in CheckQuery.
+*/
+func CheckQueryDependent(r *http.Request, ifPresent string, thenRequired ...string) *Result {
+	v := r.URL.Query()
+
+	if v.Get(ifPresent) == "" {
+		return &StatusOK
+	}
+
+	for _, k := range thenRequired {
+		if v.Get(k) == "" {
+			return BadRequest("parameter " + k + " is required when " + ifPresent + " is set")
+		}
+	}
+
+	return &StatusOK
+}
+
+/*
+EchoParams returns the first value of each of the allowed query parameters present in r e.g.,
+to echo the query back to the client in a response envelope.  Other parameters are excluded.
+Control characters are removed from the values.  The values are otherwise unchanged so they
+must still be escaped for the response format e.g., by encoding/json or html/template.
+*/
+func EchoParams(r *http.Request, allowed []string) map[string]string {
+	v := r.URL.Query()
+	e := make(map[string]string)
+
+	for _, k := range allowed {
+		if s, ok := v[k]; ok && len(s) > 0 {
+			e[k] = strings.Map(func(c rune) rune {
+				if unicode.IsControl(c) {
+					return -1
+				}
+				return c
+			}, s[0])
+		}
+	}
+
+	return e
+}
+
+// MaxZoom is the largest tile zoom level accepted by CheckZoom.
+const MaxZoom = 22
+
+/*
+CheckZoom parses query parameter name from r as a tile zoom level.  BadRequest
+is returned if the parameter is missing, not an integer, or not between 0 and MaxZoom.
+*/
+func CheckZoom(r *http.Request, name string) (int, *Result) {
+	s := r.URL.Query().Get(name)
+	if s == "" {
+		return 0, BadRequest("missing required query parameter: " + name)
+	}
+
+	z, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, BadRequest("invalid integer for parameter: " + name)
+	}
+
+	if z < 0 || z > MaxZoom {
+		return 0, BadRequest("parameter " + name + " must be between 0 and " + strconv.Itoa(MaxZoom))
+	}
+
+	return z, &StatusOK
+}
+
+// epochMillisMin is the smallest integer that ParseTimeParam treats as epoch milliseconds.
+// As seconds it is more than 3000 years in the future.
+const epochMillisMin = 100000000000
+
+/*
+ParseTimeParam parses query parameter name from r as a time.  The accepted formats
+are tried in turn:
+
+	RFC3339 e.g., 2016-01-02T03:04:05Z
+	Unix epoch seconds e.g., 1451703845
+	Unix epoch milliseconds e.g., 1451703845000
+
+A bare integer is ambiguous.  It is treated as epoch seconds unless its absolute
+value is 100000000000 or more, in which case it is treated as epoch milliseconds.
+
+BadRequest is returned if the parameter is missing, no format matches, or the time is
+outside the years 1 to 9999.
+*/
+func ParseTimeParam(r *http.Request, name string) (time.Time, *Result) {
+	s := r.URL.Query().Get(name)
+	if s == "" {
+		return time.Time{}, BadRequest("missing required query parameter: " + name)
+	}
+
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, &StatusOK
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}, BadRequest("invalid time for parameter: " + name)
+	}
+
+	t := time.Unix(n, 0).UTC()
+	if n >= epochMillisMin || n <= -epochMillisMin {
+		t = time.UnixMilli(n).UTC()
+	}
+
+	if t.Year() < 1 || t.Year() > 9999 {
+		return time.Time{}, BadRequest("invalid time for parameter: " + name)
+	}
+
+	return t, &StatusOK
+}
+
+var errBadTime = errors.New("invalid time")
+
+// setField converts s to the type of f and sets f.
+func setField(f reflect.Value, s string) error {
+	if f.Type() == timeType {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return errBadTime
+		}
+		f.Set(reflect.ValueOf(t))
+		return nil
+	}
+
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(s)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(s, 10, f.Type().Bits())
+		if err != nil {
+			return err
+		}
+		f.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		i, err := strconv.ParseUint(s, 10, f.Type().Bits())
+		if err != nil {
+			return err
+		}
+		f.SetUint(i)
+	case reflect.Float32, reflect.Float64:
+		x, err := strconv.ParseFloat(s, f.Type().Bits())
+		if err != nil {
+			return err
+		}
+		f.SetFloat(x)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		f.SetBool(b)
+	default:
+		return errors.New("BindQuery unsupported field type " + f.Type().String())
+	}
+
+	return nil
+}
@@ -0,0 +1,604 @@
+package weft
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type bindTest struct {
+	PublicID  string    `query:"publicID,required"`
+	MinMag    float64   `query:"minmag"`
+	Limit     int       `query:"limit"`
+	Depth     uint32    `query:"depth"`
+	Felt      bool      `query:"felt"`
+	StartTime time.Time `query:"startTime"`
+	Ignored   string
+}
+
+func TestBindQuery(t *testing.T) {
+	r, err := http.NewRequest("GET", "http://test.com?publicID=2016p123456&minmag=3.5&limit=10&depth=20&felt=true&startTime=2016-05-18T04:21:58Z", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var q bindTest
+
+	if res := BindQuery(r, &q); !res.Ok {
+		t.Fatalf("expected ok got %d %s", res.Code, res.Msg)
+	}
+
+	if q.PublicID != "2016p123456" {
+		t.Errorf("expected publicID 2016p123456 got %s", q.PublicID)
+	}
+
+	if q.MinMag != 3.5 {
+		t.Errorf("expected minmag 3.5 got %f", q.MinMag)
+	}
+
+	if q.Limit != 10 {
+		t.Errorf("expected limit 10 got %d", q.Limit)
+	}
+
+	if q.Depth != 20 {
+		t.Errorf("expected depth 20 got %d", q.Depth)
+	}
+
+	if !q.Felt {
+		t.Error("expected felt true")
+	}
+
+	if !q.StartTime.Equal(time.Date(2016, time.May, 18, 4, 21, 58, 0, time.UTC)) {
+		t.Errorf("wrong startTime %s", q.StartTime)
+	}
+
+	// optional parameters are not required and leave the field unchanged.
+	r, err = http.NewRequest("GET", "http://test.com?publicID=2016p123456", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q = bindTest{Limit: 100}
+
+	if res := BindQuery(r, &q); !res.Ok {
+		t.Fatalf("expected ok got %d %s", res.Code, res.Msg)
+	}
+
+	if q.Limit != 100 {
+		t.Errorf("expected default limit 100 got %d", q.Limit)
+	}
+
+	// validation failures.
+	in := []struct {
+		query string
+		msg   string
+	}{
+		{"", "missing required query parameter: publicID"},
+		{"minmag=3.5", "missing required query parameter: publicID"},
+		{"publicID=2016p123456&minmag=big", "invalid value for query parameter: minmag"},
+		{"publicID=2016p123456&limit=1.5", "invalid value for query parameter: limit"},
+		{"publicID=2016p123456&depth=-1", "invalid value for query parameter: depth"},
+		{"publicID=2016p123456&felt=maybe", "invalid value for query parameter: felt"},
+		{"publicID=2016p123456&startTime=yesterday", "invalid value for query parameter: startTime"},
+	}
+
+	for _, v := range in {
+		r, err = http.NewRequest("GET", "http://test.com?"+v.query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res := BindQuery(r, &bindTest{})
+
+		if res.Code != http.StatusBadRequest {
+			t.Errorf("%s expected code %d got %d", v.query, http.StatusBadRequest, res.Code)
+		}
+
+		if res.Msg != v.msg {
+			t.Errorf("%s expected message %s got %s", v.query, v.msg, res.Msg)
+		}
+	}
+
+	// dst must be a pointer to a struct.
+	if res := BindQuery(r, bindTest{}); res.Code != http.StatusInternalServerError {
+		t.Errorf("expected code %d got %d", http.StatusInternalServerError, res.Code)
+	}
+}
+
+func TestFormatParam(t *testing.T) {
+	allowed := map[string]string{
+		"json": "application/json",
+		"csv":  "text/csv",
+		"xml":  "application/xml",
+	}
+
+	in := []struct {
+		query       string
+		format      string
+		contentType string
+		code        int
+	}{
+		{"format=json", "json", "application/json", http.StatusOK},
+		{"format=csv", "csv", "text/csv", http.StatusOK},
+		{"format=xml", "xml", "application/xml", http.StatusOK},
+		{"", "json", "application/json", http.StatusOK},
+		{"format=geojson", "", "", http.StatusBadRequest},
+	}
+
+	for _, v := range in {
+		r, err := http.NewRequest("GET", "http://test.com?"+v.query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f, c, res := FormatParam(r, allowed, "json")
+
+		if res.Code != v.code {
+			t.Errorf("%s expected code %d got %d", v.query, v.code, res.Code)
+		}
+
+		if f != v.format {
+			t.Errorf("%s expected format %s got %s", v.query, v.format, f)
+		}
+
+		if c != v.contentType {
+			t.Errorf("%s expected content type %s got %s", v.query, v.contentType, c)
+		}
+	}
+}
+
+func TestCheckQueryFloat(t *testing.T) {
+	in := []struct {
+		query    string
+		expected float64
+		msg      string
+	}{
+		{"minmag=4.5", 4.5, ""},
+		{"minmag=-1", -1, ""},
+		{"minmag=3", 3, ""},
+		{"minmag=1e2", 100, ""},
+		{"minmag=big", 0, "invalid number for parameter: minmag"},
+		{"minmag=4.5.1", 0, "invalid number for parameter: minmag"},
+		{"minmag=NaN", 0, "invalid number for parameter: minmag"},
+		{"minmag=Inf", 0, "invalid number for parameter: minmag"},
+		{"minmag=-Inf", 0, "invalid number for parameter: minmag"},
+		{"minmag=1e400", 0, "invalid number for parameter: minmag"},
+		{"", 0, "missing required query parameter: minmag"},
+	}
+
+	for _, v := range in {
+		r, err := http.NewRequest("GET", "http://test.com?"+v.query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f, res := CheckQueryFloat(r, "minmag")
+
+		switch v.msg {
+		case "":
+			if !res.Ok {
+				t.Errorf("%s expected ok got %s", v.query, res.Msg)
+			}
+		default:
+			if res.Code != http.StatusBadRequest {
+				t.Errorf("%s expected code %d got %d", v.query, http.StatusBadRequest, res.Code)
+			}
+			if res.Msg != v.msg {
+				t.Errorf("%s expected message %s got %s", v.query, v.msg, res.Msg)
+			}
+		}
+
+		if f != v.expected {
+			t.Errorf("%s expected %f got %f", v.query, v.expected, f)
+		}
+	}
+}
+
+func TestCheckQueryRange(t *testing.T) {
+	in := []struct {
+		query    string
+		expected float64
+		msg      string
+	}{
+		{"radius=50", 50, ""},
+		{"radius=0", 0, ""},
+		{"radius=100", 100, ""},
+		{"radius=12.5", 12.5, ""},
+		{"radius=-0.1", 0, "parameter radius must be between 0 and 100"},
+		{"radius=100.5", 0, "parameter radius must be between 0 and 100"},
+		{"radius=far", 0, "invalid number for parameter: radius"},
+		{"radius=NaN", 0, "invalid number for parameter: radius"},
+		{"", 0, "missing required query parameter: radius"},
+	}
+
+	for _, v := range in {
+		r, err := http.NewRequest("GET", "http://test.com?"+v.query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f, res := CheckQueryRange(r, "radius", 0, 100)
+
+		switch v.msg {
+		case "":
+			if !res.Ok {
+				t.Errorf("%s expected ok got %s", v.query, res.Msg)
+			}
+		default:
+			if res.Code != http.StatusBadRequest {
+				t.Errorf("%s expected code %d got %d", v.query, http.StatusBadRequest, res.Code)
+			}
+			if res.Msg != v.msg {
+				t.Errorf("%s expected message %s got %s", v.query, v.msg, res.Msg)
+			}
+		}
+
+		if f != v.expected {
+			t.Errorf("%s expected %f got %f", v.query, v.expected, f)
+		}
+	}
+}
+
+func TestCheckQueryValid(t *testing.T) {
+	params := Parameters{
+		{Name: "station", Required: true, Pattern: "^[A-Z]{3,5}$"},
+		{Name: "network", Pattern: "^[A-Z]{2}$"},
+		{Name: "limit"},
+		{Name: "format", Values: []string{"csv", "json", "xml"}},
+		{Name: "page"},
+		{Name: "id", Multi: true, Pattern: "^[0-9]+$"},
+	}
+
+	in := []struct {
+		query string
+		code  int
+		msg   string
+	}{
+		{"station=WEL", http.StatusOK, ""},
+		{"station=WEL&format=csv", http.StatusOK, ""},
+		{"station=WEL&format=xml", http.StatusOK, ""},
+		{"station=WEL&format=html", http.StatusBadRequest, "unknown value for parameter: format"},
+		{"station=WEL&format=", http.StatusBadRequest, "unknown value for parameter: format"},
+		{"station=WEL&limit=anything", http.StatusOK, ""},
+		{"station=WEL&page=1", http.StatusOK, ""},
+		{"station=WEL&page=1&page=2", http.StatusBadRequest, "parameter may not repeat: page"},
+		{"station=WEL&station=WHATA", http.StatusBadRequest, "parameter may not repeat: station"},
+		{"station=WEL&id=1", http.StatusOK, ""},
+		{"station=WEL&id=1&id=2&id=3", http.StatusOK, ""},
+		{"station=WEL&id=1&id=x", http.StatusBadRequest, "invalid value for parameter: id"},
+		{"station=WHATA&network=NZ&limit=10", http.StatusOK, ""},
+		{"station=WE", http.StatusBadRequest, "invalid value for parameter: station"},
+		{"station=wel", http.StatusBadRequest, "invalid value for parameter: station"},
+		{"station=WELLINGTON", http.StatusBadRequest, "invalid value for parameter: station"},
+		{"station=WEL&network=nz", http.StatusBadRequest, "invalid value for parameter: network"},
+		{"network=NZ", http.StatusBadRequest, "missing required query parameter: station"},
+		{"station=WEL&extra=1", http.StatusBadRequest, "found additional query parameters"},
+	}
+
+	for _, v := range in {
+		r, err := http.NewRequest("GET", "http://test.com?"+v.query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res := CheckQueryValid(r, params)
+
+		if res.Code != v.code {
+			t.Errorf("%s expected code %d got %d", v.query, v.code, res.Code)
+		}
+
+		if res.Msg != v.msg {
+			t.Errorf("%s expected message %s got %s", v.query, v.msg, res.Msg)
+		}
+	}
+
+	// invalid patterns are a server error.
+	r, err := http.NewRequest("GET", "http://test.com?station=WEL", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res := CheckQueryValid(r, Parameters{{Name: "station", Pattern: "[A-Z"}}); res.Code != http.StatusInternalServerError {
+		t.Errorf("expected code %d got %d", http.StatusInternalServerError, res.Code)
+	}
+}
+
+func TestCheckQueryValidIgnoreCase(t *testing.T) {
+	params := Parameters{
+		{Name: "format", Values: []string{"json", "csv"}, IgnoreCase: true},
+		{Name: "type", Values: []string{"QuakeML"}, IgnoreCase: true, Multi: true},
+		{Name: "limit"},
+	}
+
+	in := []struct {
+		query  string
+		code   int
+		format string
+		types  []string
+		limit  string
+	}{
+		{"format=json", http.StatusOK, "json", nil, ""},
+		{"format=JSON", http.StatusOK, "json", nil, ""},
+		{"format=Csv&limit=10", http.StatusOK, "csv", nil, "10"},
+		{"type=quakeml&type=QUAKEML", http.StatusOK, "", []string{"QuakeML", "QuakeML"}, ""},
+		{"format=html", http.StatusBadRequest, "html", nil, ""},
+		{"format=JSONP", http.StatusBadRequest, "JSONP", nil, ""},
+	}
+
+	for _, v := range in {
+		r, err := http.NewRequest("GET", "http://test.com?"+v.query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if res := CheckQueryValid(r, params); res.Code != v.code {
+			t.Errorf("%s expected code %d got %d", v.query, v.code, res.Code)
+		}
+
+		q := r.URL.Query()
+
+		if q.Get("format") != v.format {
+			t.Errorf("%s expected format %s got %s", v.query, v.format, q.Get("format"))
+		}
+
+		if v.types != nil && !reflect.DeepEqual(q["type"], v.types) {
+			t.Errorf("%s expected type %v got %v", v.query, v.types, q["type"])
+		}
+
+		if q.Get("limit") != v.limit {
+			t.Errorf("%s expected limit %s got %s", v.query, v.limit, q.Get("limit"))
+		}
+	}
+
+	// without IgnoreCase values are case-sensitive.
+	r, err := http.NewRequest("GET", "http://test.com?format=JSON", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res := CheckQueryValid(r, Parameters{{Name: "format", Values: []string{"json"}}}); res.Code != http.StatusBadRequest {
+		t.Errorf("expected code %d got %d", http.StatusBadRequest, res.Code)
+	}
+}
+
+func TestExampleURL(t *testing.T) {
+	params := Parameters{
+		{Name: "publicID", Required: true, Example: "2016p123456"},
+		{Name: "limit"},
+		{Name: "format", Values: []string{"json", "csv"}, Example: "json"},
+		{Name: "region", Example: "new zealand"},
+	}
+
+	in := []struct {
+		params   Parameters
+		expected string
+	}{
+		{params, "/quake?publicID=2016p123456&format=json&region=new+zealand"},
+		{Parameters{{Name: "limit"}}, "/quake"},
+		{nil, "/quake"},
+	}
+
+	for _, v := range in {
+		if u := v.params.ExampleURL("/quake"); u != v.expected {
+			t.Errorf("expected %s got %s", v.expected, u)
+		}
+	}
+}
+
+func TestEchoParams(t *testing.T) {
+	allowed := []string{"publicID", "limit", "region"}
+
+	in := []struct {
+		query    string
+		expected map[string]string
+	}{
+		{"", map[string]string{}},
+		{"publicID=2016p123456&limit=10", map[string]string{"publicID": "2016p123456", "limit": "10"}},
+		{"publicID=2016p123456&token=secret&callback=alert(1)", map[string]string{"publicID": "2016p123456"}},
+		{"limit=10&limit=20", map[string]string{"limit": "10"}},
+		{"limit=", map[string]string{"limit": ""}},
+		{"region=new%0Azealand%00%1B", map[string]string{"region": "newzealand"}},
+		{"region=%3Cscript%3E", map[string]string{"region": "<script>"}},
+	}
+
+	for _, v := range in {
+		r, err := http.NewRequest("GET", "http://test.com?"+v.query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if e := EchoParams(r, allowed); !reflect.DeepEqual(e, v.expected) {
+			t.Errorf("%s expected %v got %v", v.query, v.expected, e)
+		}
+	}
+}
+
+func TestCheckExclusive(t *testing.T) {
+	in := []struct {
+		query string
+		msg   string
+	}{
+		{"bbox=165,-48,179,-34", ""},
+		{"minlat=-48&maxlat=-34", ""},
+		{"minlat=-48&maxlat=-34&minlon=165&maxlon=179", ""},
+		{"", ""},
+		{"limit=10", ""},
+		{"bbox=165,-48,179,-34&minlat=-48", "parameters bbox and minlat can not be used together"},
+		{"maxlon=179&bbox=165,-48,179,-34", "parameters bbox and maxlon can not be used together"},
+	}
+
+	for _, v := range in {
+		r, err := http.NewRequest("GET", "http://test.com?"+v.query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res := CheckExclusive(r, []string{"bbox"}, []string{"minlat", "maxlat", "minlon", "maxlon"})
+
+		switch v.msg {
+		case "":
+			if !res.Ok {
+				t.Errorf("%s expected ok got %s", v.query, res.Msg)
+			}
+		default:
+			if res.Code != http.StatusBadRequest {
+				t.Errorf("%s expected code %d got %d", v.query, http.StatusBadRequest, res.Code)
+			}
+			if res.Msg != v.msg {
+				t.Errorf("%s expected message %s got %s", v.query, v.msg, res.Msg)
+			}
+		}
+	}
+
+	// composes with CheckQuery which still finds unexpected parameters.
+	r, err := http.NewRequest("GET", "http://test.com?bbox=165,-48,179,-34&extra=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !CheckExclusive(r, []string{"bbox"}, []string{"minlat"}).Ok {
+		t.Error("expected exclusive groups to be ok")
+	}
+
+	if CheckQuery(r, []string{}, []string{"bbox", "minlat"}).Ok {
+		t.Error("expected CheckQuery to find the extra parameter")
+	}
+}
+
+func TestCheckQueryDependent(t *testing.T) {
+	in := []struct {
+		query string
+		msg   string
+	}{
+		{"", ""},
+		{"starttime=2016-01-02T00:00:00Z&endtime=2016-01-03T00:00:00Z&limit=10", ""},
+		{"endtime=2016-01-03T00:00:00Z", ""},
+		{"limit=10", ""},
+		{"starttime=2016-01-02T00:00:00Z", "parameter endtime is required when starttime is set"},
+		{"starttime=2016-01-02T00:00:00Z&endtime=", "parameter endtime is required when starttime is set"},
+		{"starttime=2016-01-02T00:00:00Z&endtime=2016-01-03T00:00:00Z", "parameter limit is required when starttime is set"},
+		{"starttime=&limit=10", ""},
+	}
+
+	for _, v := range in {
+		r, err := http.NewRequest("GET", "http://test.com?"+v.query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res := CheckQueryDependent(r, "starttime", "endtime", "limit")
+
+		switch v.msg {
+		case "":
+			if !res.Ok {
+				t.Errorf("%s expected ok got %s", v.query, res.Msg)
+			}
+		default:
+			if res.Code != http.StatusBadRequest {
+				t.Errorf("%s expected code %d got %d", v.query, http.StatusBadRequest, res.Code)
+			}
+			if res.Msg != v.msg {
+				t.Errorf("%s expected message %s got %s", v.query, v.msg, res.Msg)
+			}
+		}
+	}
+}
+
+func TestCheckZoom(t *testing.T) {
+	in := []struct {
+		query    string
+		expected int
+		msg      string
+	}{
+		{"z=0", 0, ""},
+		{"z=12", 12, ""},
+		{"z=22", 22, ""},
+		{"z=-1", 0, "parameter z must be between 0 and 22"},
+		{"z=23", 0, "parameter z must be between 0 and 22"},
+		{"z=1.5", 0, "invalid integer for parameter: z"},
+		{"z=high", 0, "invalid integer for parameter: z"},
+		{"", 0, "missing required query parameter: z"},
+	}
+
+	for _, v := range in {
+		r, err := http.NewRequest("GET", "http://test.com?"+v.query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		z, res := CheckZoom(r, "z")
+
+		switch v.msg {
+		case "":
+			if !res.Ok {
+				t.Errorf("%s expected ok got %s", v.query, res.Msg)
+			}
+		default:
+			if res.Code != http.StatusBadRequest {
+				t.Errorf("%s expected code %d got %d", v.query, http.StatusBadRequest, res.Code)
+			}
+			if res.Msg != v.msg {
+				t.Errorf("%s expected message %s got %s", v.query, v.msg, res.Msg)
+			}
+		}
+
+		if z != v.expected {
+			t.Errorf("%s expected %d got %d", v.query, v.expected, z)
+		}
+	}
+}
+
+func TestParseTimeParam(t *testing.T) {
+	d := time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	in := []struct {
+		query    string
+		expected time.Time
+		msg      string
+	}{
+		{"time=2016-01-02T03:04:05Z", d, ""},
+		{"time=2016-01-02T16:04:05%2B13:00", d, ""},
+		{"time=1451703845", d, ""},
+		{"time=1451703845000", d, ""},
+		{"time=1451703845123", d.Add(123 * time.Millisecond), ""},
+		{"time=0", time.Unix(0, 0), ""},
+		{"time=99999999999", time.Unix(99999999999, 0), ""},
+		{"time=100000000000", time.Unix(100000000, 0), ""},
+		{"time=2016-01-02", time.Time{}, "invalid time for parameter: time"},
+		{"time=1451703845.5", time.Time{}, "invalid time for parameter: time"},
+		{"time=yesterday", time.Time{}, "invalid time for parameter: time"},
+		{"time=253402300799999", time.Date(9999, 12, 31, 23, 59, 59, 999000000, time.UTC), ""},
+		{"time=253402300800000", time.Time{}, "invalid time for parameter: time"},
+		{"time=99999999999999999", time.Time{}, "invalid time for parameter: time"},
+		{"time=-99999999999999999", time.Time{}, "invalid time for parameter: time"},
+		{"", time.Time{}, "missing required query parameter: time"},
+	}
+
+	for _, v := range in {
+		r, err := http.NewRequest("GET", "http://test.com?"+v.query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tm, res := ParseTimeParam(r, "time")
+
+		switch v.msg {
+		case "":
+			if !res.Ok {
+				t.Errorf("%s expected ok got %s", v.query, res.Msg)
+			}
+		default:
+			if res.Code != http.StatusBadRequest {
+				t.Errorf("%s expected code %d got %d", v.query, http.StatusBadRequest, res.Code)
+			}
+			if res.Msg != v.msg {
+				t.Errorf("%s expected message %s got %s", v.query, v.msg, res.Msg)
+			}
+		}
+
+		if !tm.Equal(v.expected) {
+			t.Errorf("%s expected %s got %s", v.query, v.expected, tm)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package weft
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+/*
+unsatisfiableRange returns true if r is a GET request with a Range header in bytes
+that can not be satisfied for a body of size total.  A range set is unsatisfiable
+if none of its ranges start before total and it has no non zero suffix ranges.
+
+Malformed Range headers are ignored (return false) so that the full body is served.
+*/
+func unsatisfiableRange(r *http.Request, total int) bool {
+	if r.Method != "GET" {
+		return false
+	}
+
+	h := r.Header.Get("Range")
+	if !strings.HasPrefix(h, "bytes=") {
+		return false
+	}
+
+	var ranges int
+
+	for _, s := range strings.Split(strings.TrimPrefix(h, "bytes="), ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+
+		i := strings.Index(s, "-")
+		if i < 0 {
+			return false
+		}
+
+		start, end := s[:i], s[i+1:]
+
+		switch start {
+		case "":
+			n, err := strconv.ParseInt(end, 10, 64)
+			if err != nil || n < 0 {
+				return false
+			}
+			if n > 0 && total > 0 {
+				return false
+			}
+		default:
+			n, err := strconv.ParseInt(start, 10, 64)
+			if err != nil || n < 0 {
+				return false
+			}
+			if end != "" {
+				e, err := strconv.ParseInt(end, 10, 64)
+				if err != nil || e < n {
+					return false
+				}
+			}
+			if n < int64(total) {
+				return false
+			}
+		}
+
+		ranges++
+	}
+
+	return ranges > 0
+}
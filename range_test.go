@@ -0,0 +1,146 @@
+package weft
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestUnsatisfiableRange(t *testing.T) {
+	in := []struct {
+		method string
+		header string
+		total  int
+		expect bool
+	}{
+		{"GET", "", 100, false},
+		{"GET", "bytes=0-10", 100, false},
+		{"GET", "bytes=99-", 100, false},
+		{"GET", "bytes=100-", 100, true},
+		{"GET", "bytes=100-200", 100, true},
+		{"GET", "bytes=200-300, 0-10", 100, false},
+		{"GET", "bytes=200-300, 400-", 100, true},
+		{"GET", "bytes=-10", 100, false},
+		{"GET", "bytes=-0", 100, true},
+		{"GET", "bytes=-10", 0, true},
+		{"GET", "bytes=10-5", 100, false},
+		{"GET", "bytes=a-", 100, false},
+		{"GET", "items=200-", 100, false},
+		{"HEAD", "bytes=200-", 100, false},
+	}
+
+	for _, v := range in {
+		r := httptest.NewRequest(v.method, "http://test.com/quake", nil)
+		if v.header != "" {
+			r.Header.Set("Range", v.header)
+		}
+
+		if u := unsatisfiableRange(r, v.total); u != v.expect {
+			t.Errorf("%s %s total %d expected %t got %t", v.method, v.header, v.total, v.expect, u)
+		}
+	}
+}
+
+func TestWriteBytesRange(t *testing.T) {
+	h := func(r *http.Request, h http.Header, b *bytes.Buffer) *Result {
+		h.Set("Content-Type", "text/plain")
+		b.WriteString("0123456789")
+		return &Result{
+			Ok:            true,
+			Code:          http.StatusOK,
+			Modified:      time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC),
+			SurrogateKeys: []string{"quake"},
+			Age:           time.Minute,
+		}
+	}
+
+	validators := []string{"ETag", "Last-Modified", "Surrogate-Key", "Age"}
+
+	r := httptest.NewRequest("GET", "http://test.com/quake", nil)
+	r.Header.Set("Range", "bytes=20-")
+	r.Header.Set("Accept-Encoding", "gzip")
+
+	w := httptest.NewRecorder()
+	MakeHandlerAPI(h).ServeHTTP(w, r)
+
+	if w.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("expected code %d got %d", http.StatusRequestedRangeNotSatisfiable, w.Code)
+	}
+
+	if c := w.Header().Get("Content-Range"); c != "bytes */10" {
+		t.Errorf("expected Content-Range bytes */10 got %s", c)
+	}
+
+	if w.Body.String() != "range not satisfiable" {
+		t.Errorf("expected short message got %s", w.Body.String())
+	}
+
+	for _, k := range validators {
+		if s := w.Header().Get(k); s != "" {
+			t.Errorf("expected no %s for the 416 got %s", k, s)
+		}
+	}
+
+	// satisfiable ranges are ignored.
+	r.Header.Set("Range", "bytes=2-4")
+
+	w = httptest.NewRecorder()
+	MakeHandlerAPI(h).ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("expected code %d got %d", http.StatusOK, w.Code)
+	}
+
+	if w.Body.String() != "0123456789" {
+		t.Errorf("expected full body got %s", w.Body.String())
+	}
+
+	for _, k := range validators {
+		if w.Header().Get(k) == "" {
+			t.Errorf("expected %s for the full body", k)
+		}
+	}
+}
+
+func TestWriteBytesRangeCaching(t *testing.T) {
+	h := func(r *http.Request, h http.Header, b *bytes.Buffer) *Result {
+		h.Set("Content-Type", "text/plain")
+		b.WriteString("0123456789")
+		return &StatusOK
+	}
+
+	in := []struct {
+		rng       string
+		code      int
+		surrogate string
+		vary      string
+	}{
+		{"", http.StatusOK, "max-age=10", "Accept-Encoding"},
+		{"bytes=2-4", http.StatusOK, "max-age=10", "Accept-Encoding"},
+		{"bytes=20-", http.StatusRequestedRangeNotSatisfiable, "no-store", "Accept-Encoding, Range"},
+	}
+
+	for _, v := range in {
+		r := httptest.NewRequest("GET", "http://test.com/quake", nil)
+		if v.rng != "" {
+			r.Header.Set("Range", v.rng)
+		}
+
+		w := httptest.NewRecorder()
+		MakeHandlerAPI(h).ServeHTTP(w, r)
+
+		if w.Code != v.code {
+			t.Errorf("%s expected code %d got %d", v.rng, v.code, w.Code)
+		}
+
+		if s := w.Header().Get("Surrogate-Control"); s != v.surrogate {
+			t.Errorf("%s expected Surrogate-Control %s got %s", v.rng, v.surrogate, s)
+		}
+
+		if s := w.Header().Get("Vary"); s != v.vary {
+			t.Errorf("%s expected Vary %s got %s", v.rng, v.vary, s)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package weft
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxBuckets is the number of buckets a RateLimiter holds before removing full buckets.
+const maxBuckets = 10000
+
+// RateLimiter is a token bucket rate limiter with a bucket for each key.
+type RateLimiter struct {
+	sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a RateLimiter that allows rate requests per second
+// for each key with bursts of up to burst requests.
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	return &RateLimiter{rate: rate, burst: float64(burst), buckets: make(map[string]*bucket)}
+}
+
+// Allow returns true if a request for key is allowed.
+func (l *RateLimiter) Allow(key string) bool {
+	l.Lock()
+	defer l.Unlock()
+
+	now := time.Now()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxBuckets {
+			l.prune(now)
+		}
+
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+
+	return true
+}
+
+// prune removes buckets that have refilled.  Must be called with l locked.
+func (l *RateLimiter) prune(now time.Time) {
+	for k, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, k)
+		}
+	}
+}
+
+/*
+RateLimit wraps h and returns http.StatusTooManyRequests when l does not allow
+a request for the key returned by key(r) e.g., to limit each client separately
+for an expensive endpoint:
+
+	weft.RateLimit(limiter, weft.RouteKey("quakes"), quakesHandler)
+*/
+func RateLimit(l *RateLimiter, key func(r *http.Request) string, h RequestHandler) RequestHandler {
+	return func(r *http.Request, header http.Header, b *bytes.Buffer) *Result {
+		if !l.Allow(key(r)) {
+			return &Result{Ok: false, Code: http.StatusTooManyRequests, Msg: "too many requests"}
+		}
+
+		return h(r, header, b)
+	}
+}
+
+// ClientIP returns the IP address of the client for r from r.RemoteAddr.
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// RouteKey returns a key function for RateLimit combining the client IP with route
+// so that a client has a separate limit for each route sharing a RateLimiter.
+func RouteKey(route string) func(r *http.Request) string {
+	return func(r *http.Request) string {
+		return ClientIP(r) + " " + route
+	}
+}
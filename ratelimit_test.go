@@ -0,0 +1,71 @@
+package weft
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimit(t *testing.T) {
+	h := func(r *http.Request, h http.Header, b *bytes.Buffer) *Result {
+		return &StatusOK
+	}
+
+	// effectively no refill during the test.
+	l := NewRateLimiter(0.001, 2)
+
+	cheap := MakeHandlerAPI(RateLimit(l, RouteKey("cheap"), h))
+	expensive := MakeHandlerAPI(RateLimit(l, RouteKey("expensive"), h))
+
+	do := func(f http.HandlerFunc, remote string, code int) {
+		r, err := http.NewRequest("GET", "http://test.com", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.RemoteAddr = remote
+
+		w := httptest.NewRecorder()
+		f.ServeHTTP(w, r)
+
+		if w.Code != code {
+			t.Errorf("%s expected code %d got %d", loc(), code, w.Code)
+		}
+
+		if code == http.StatusTooManyRequests && w.Header().Get("Surrogate-Control") != "no-store" {
+			t.Errorf("%s expected Surrogate-Control no-store got %s", loc(), w.Header().Get("Surrogate-Control"))
+		}
+	}
+
+	// the client uses up its limit for the cheap endpoint.
+	do(cheap, "192.0.2.1:1234", http.StatusOK)
+	do(cheap, "192.0.2.1:1235", http.StatusOK)
+	do(cheap, "192.0.2.1:1236", http.StatusTooManyRequests)
+
+	// the expensive endpoint has a separate limit for the same client.
+	do(expensive, "192.0.2.1:1237", http.StatusOK)
+	do(expensive, "192.0.2.1:1238", http.StatusOK)
+	do(expensive, "192.0.2.1:1239", http.StatusTooManyRequests)
+
+	// other clients are not limited.
+	do(cheap, "192.0.2.2:1234", http.StatusOK)
+}
+
+func TestRateLimiterRefill(t *testing.T) {
+	l := NewRateLimiter(100, 1)
+
+	if !l.Allow("a") {
+		t.Error("expected first request to be allowed")
+	}
+
+	if l.Allow("a") {
+		t.Error("expected second request to be limited")
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	if !l.Allow("a") {
+		t.Error("expected request to be allowed after refill")
+	}
+}
@@ -0,0 +1,208 @@
+package weft
+
+import (
+	"bytes"
+	"compress/gzip"
+	"github.com/andybalholm/brotli"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+/*
+CheckContentLength returns http.StatusRequestEntityTooLarge if the Content-Length
+declared for r is greater than max.
+
+When the length is unknown (-1) r.Body is limited to max bytes instead.  Reading past
+the limit returns an error which the handler should treat as the request being too large.
+*/
+func CheckContentLength(r *http.Request, max int64) *Result {
+	switch {
+	case r.ContentLength > max:
+		return &Result{Ok: false, Code: http.StatusRequestEntityTooLarge, Msg: "request body too large"}
+	case r.ContentLength < 0 && r.Body != nil:
+		r.Body = http.MaxBytesReader(nil, r.Body, max)
+	}
+
+	return &StatusOK
+}
+
+/*
+RejectBody returns BadRequest if r is a GET, HEAD, or DELETE request with a body.
+A zero Content-Length passes.  When the length is unknown (-1) a byte is read from
+the body to check for content.
+*/
+func RejectBody(r *http.Request) *Result {
+	switch r.Method {
+	case "GET", "HEAD", "DELETE":
+	default:
+		return &StatusOK
+	}
+
+	switch {
+	case r.ContentLength > 0:
+		return BadRequest("unexpected request body")
+	case r.ContentLength < 0 && r.Body != nil && r.Body != http.NoBody:
+		var p [1]byte
+		if n, _ := r.Body.Read(p[:]); n > 0 {
+			return BadRequest("unexpected request body")
+		}
+	}
+
+	return &StatusOK
+}
+
+/*
+Protocol returns the HTTP protocol version of r e.g., "HTTP/1.1" or "HTTP/2"
+so handlers can gate features that depend on the protocol.
+*/
+func Protocol(r *http.Request) string {
+	if r.ProtoMajor >= 2 {
+		return "HTTP/" + strconv.Itoa(r.ProtoMajor)
+	}
+
+	return "HTTP/" + strconv.Itoa(r.ProtoMajor) + "." + strconv.Itoa(r.ProtoMinor)
+}
+
+// MaxDecompressedSize is the largest request body, in bytes, that DecompressBody will
+// decompress.  It protects against small compressed bodies that expand to exhaust memory.
+// Zero disables the limit.  Set during init.
+var MaxDecompressedSize int64 = 10 << 20
+
+/*
+DecompressBody replaces the body of r with the decompressed body for requests with a gzip
+or br Content-Encoding so that handlers read plain content.  The Content-Encoding header
+is removed and ContentLength set to the decompressed length.  Requests without a
+Content-Encoding are unchanged.
+
+BadRequest is returned for malformed bodies and http.StatusUnsupportedMediaType for
+other encodings.  http.StatusRequestEntityTooLarge is returned if the decompressed body
+is larger than MaxDecompressedSize.
+*/
+func DecompressBody(r *http.Request) *Result {
+	var d io.Reader
+
+	switch strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))) {
+	case "", "identity":
+		return &StatusOK
+	case "gzip":
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return BadRequest("malformed gzip request body")
+		}
+		defer gz.Close()
+		d = gz
+	case "br":
+		d = brotli.NewReader(r.Body)
+	default:
+		return &Result{Ok: false, Code: http.StatusUnsupportedMediaType, Msg: "unsupported Content-Encoding"}
+	}
+
+	if MaxDecompressedSize > 0 {
+		d = io.LimitReader(d, MaxDecompressedSize+1)
+	}
+
+	b, err := ioutil.ReadAll(d)
+	if err != nil {
+		return BadRequest("malformed " + r.Header.Get("Content-Encoding") + " request body")
+	}
+
+	if MaxDecompressedSize > 0 && int64(len(b)) > MaxDecompressedSize {
+		return &Result{Ok: false, Code: http.StatusRequestEntityTooLarge, Msg: "decompressed request body too large"}
+	}
+
+	r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(b))
+	r.ContentLength = int64(len(b))
+	r.Header.Del("Content-Encoding")
+
+	return &StatusOK
+}
+
+/*
+CheckOrigin is basic CSRF protection e.g., for form submissions.  It returns Forbidden if the
+Origin header of r, or the scheme and host of the Referer header when there is no Origin, is
+not one of allowed e.g., https://www.geonet.org.nz.  Requests with neither header are also
+Forbidden.  Safe methods (GET, HEAD, OPTIONS) are not checked.
+*/
+func CheckOrigin(r *http.Request, allowed []string) *Result {
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return &StatusOK
+	}
+
+	o := r.Header.Get("Origin")
+	if o == "" || o == "null" {
+		u, err := url.Parse(r.Header.Get("Referer"))
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return &Forbidden
+		}
+		o = u.Scheme + "://" + u.Host
+	}
+
+	for _, a := range allowed {
+		if strings.EqualFold(o, a) {
+			return &StatusOK
+		}
+	}
+
+	return &Forbidden
+}
+
+/*
+Flags returns the set of request-level feature flags from the comma separated
+X-Feature-Flags header of r e.g., X-Feature-Flags: beta-map, new-search.
+Flags are trimmed and lower cased.  The map is empty when the header is absent.
+
+A response that depends on the flags varies by the header.  Use AddVary(h, "X-Feature-Flags").
+*/
+func Flags(r *http.Request) map[string]bool {
+	f := make(map[string]bool)
+
+	for _, v := range r.Header["X-Feature-Flags"] {
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.ToLower(strings.TrimSpace(s)); s != "" {
+				f[s] = true
+			}
+		}
+	}
+
+	return f
+}
+
+/*
+CheckFlags is Flags with validation.  It returns BadRequest if the X-Feature-Flags header of r
+contains a flag that is not one of allowed.  allowed should be lower case.
+*/
+func CheckFlags(r *http.Request, allowed []string) (map[string]bool, *Result) {
+	f := Flags(r)
+
+	for k := range f {
+		if !contains(allowed, k) {
+			return nil, BadRequest("unknown feature flag: " + k)
+		}
+	}
+
+	return f, &StatusOK
+}
+
+/*
+CheckPathBodyMatch returns Conflict if the identifier bodyVal decoded from a request body does
+not match pathVal from the URL path e.g., for PUT /station/WEL with a body {"code":"WEL"}
+
+	if res := weft.CheckPathBodyMatch(code, s.Code); !res.Ok {
+		return res
+	}
+
+The comparison is exact.  An empty bodyVal does not match.
+*/
+func CheckPathBodyMatch(pathVal, bodyVal string) *Result {
+	if pathVal != bodyVal {
+		return Conflict("identifier in body " + strconv.Quote(bodyVal) + " does not match path " + strconv.Quote(pathVal))
+	}
+
+	return &StatusOK
+}
@@ -0,0 +1,356 @@
+package weft
+
+import (
+	"bytes"
+	"compress/gzip"
+	"github.com/andybalholm/brotli"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCheckContentLength(t *testing.T) {
+	r, err := http.NewRequest("PUT", "http://test.com", strings.NewReader("bogan impsum"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res := CheckContentLength(r, 20); !res.Ok {
+		t.Errorf("expected ok for body within limit got %d", res.Code)
+	}
+
+	if res := CheckContentLength(r, 12); !res.Ok {
+		t.Errorf("expected ok for body at limit got %d", res.Code)
+	}
+
+	if res := CheckContentLength(r, 5); res.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected %d for body over limit got %d", http.StatusRequestEntityTooLarge, res.Code)
+	}
+
+	// unknown length is limited when the body is read.
+	r, err = http.NewRequest("PUT", "http://test.com", strings.NewReader("bogan impsum"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.ContentLength = -1
+
+	if res := CheckContentLength(r, 5); !res.Ok {
+		t.Errorf("expected ok for unknown length got %d", res.Code)
+	}
+
+	if _, err := ioutil.ReadAll(r.Body); err == nil {
+		t.Error("expected error reading body over limit")
+	}
+
+	r, err = http.NewRequest("PUT", "http://test.com", strings.NewReader("bogan impsum"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.ContentLength = -1
+
+	if res := CheckContentLength(r, 20); !res.Ok {
+		t.Errorf("expected ok for unknown length got %d", res.Code)
+	}
+
+	if b, err := ioutil.ReadAll(r.Body); err != nil || string(b) != "bogan impsum" {
+		t.Errorf("expected to read body within limit got %s %v", string(b), err)
+	}
+}
+
+func TestRejectBody(t *testing.T) {
+	in := []struct {
+		method        string
+		body          string
+		contentLength int64
+		ok            bool
+	}{
+		{"GET", "", 0, true},
+		{"GET", "bogan impsum", 12, false},
+		{"GET", "bogan impsum", -1, false},
+		{"GET", "", -1, true},
+		{"DELETE", "bogan impsum", 12, false},
+		{"HEAD", "bogan impsum", 12, false},
+		{"PUT", "bogan impsum", 12, true},
+		{"POST", "bogan impsum", -1, true},
+	}
+
+	for _, v := range in {
+		r, err := http.NewRequest(v.method, "http://test.com", strings.NewReader(v.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.ContentLength = v.contentLength
+
+		res := RejectBody(r)
+
+		if res.Ok != v.ok {
+			t.Errorf("%s %q length %d expected ok %t got %t", v.method, v.body, v.contentLength, v.ok, res.Ok)
+		}
+
+		if !res.Ok && res.Code != http.StatusBadRequest {
+			t.Errorf("%s expected code %d got %d", v.method, http.StatusBadRequest, res.Code)
+		}
+	}
+}
+
+func TestProtocol(t *testing.T) {
+	in := []struct {
+		major, minor int
+		expected     string
+	}{
+		{1, 0, "HTTP/1.0"},
+		{1, 1, "HTTP/1.1"},
+		{2, 0, "HTTP/2"},
+	}
+
+	for _, v := range in {
+		r, err := http.NewRequest("GET", "http://test.com", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.ProtoMajor = v.major
+		r.ProtoMinor = v.minor
+
+		if p := Protocol(r); p != v.expected {
+			t.Errorf("expected %s got %s", v.expected, p)
+		}
+	}
+}
+
+func TestDecompressBody(t *testing.T) {
+	e := "bogan impsum bogan impsum bogan impsum"
+
+	var br bytes.Buffer
+	bw := brotli.NewWriter(&br)
+	bw.Write([]byte(e))
+	bw.Close()
+
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write([]byte(e))
+	gw.Close()
+
+	in := []struct {
+		encoding string
+		body     []byte
+		code     int
+	}{
+		{"br", br.Bytes(), http.StatusOK},
+		{"gzip", gz.Bytes(), http.StatusOK},
+		{"", []byte(e), http.StatusOK},
+		{"br", []byte(e), http.StatusBadRequest},
+		{"gzip", []byte(e), http.StatusBadRequest},
+		{"compress", []byte(e), http.StatusUnsupportedMediaType},
+	}
+
+	for _, v := range in {
+		r, err := http.NewRequest("PUT", "http://test.com", bytes.NewReader(v.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if v.encoding != "" {
+			r.Header.Set("Content-Encoding", v.encoding)
+		}
+
+		res := DecompressBody(r)
+
+		if res.Code != v.code {
+			t.Errorf("%s expected code %d got %d", v.encoding, v.code, res.Code)
+		}
+
+		if !res.Ok {
+			continue
+		}
+
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(b) != e {
+			t.Errorf("%s expected body %s got %s", v.encoding, e, string(b))
+		}
+
+		if r.Header.Get("Content-Encoding") != "" {
+			t.Errorf("%s expected Content-Encoding to be removed", v.encoding)
+		}
+	}
+}
+
+func TestDecompressBodyBomb(t *testing.T) {
+	defer func() { MaxDecompressedSize = 10 << 20 }()
+	MaxDecompressedSize = 1024
+
+	in := []struct {
+		size int
+		code int
+	}{
+		{1023, http.StatusOK},
+		{1024, http.StatusOK},
+		{1025, http.StatusRequestEntityTooLarge},
+		{1 << 20, http.StatusRequestEntityTooLarge},
+	}
+
+	for _, v := range in {
+		for _, enc := range []string{"gzip", "br"} {
+			var c bytes.Buffer
+
+			var w io.WriteCloser
+			switch enc {
+			case "gzip":
+				w = gzip.NewWriter(&c)
+			case "br":
+				w = brotli.NewWriter(&c)
+			}
+			w.Write(bytes.Repeat([]byte{'a'}, v.size))
+			w.Close()
+
+			r, err := http.NewRequest("PUT", "http://test.com", bytes.NewReader(c.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.Header.Set("Content-Encoding", enc)
+
+			if v.size > 1024 && c.Len()*10 > v.size {
+				t.Fatalf("%s %d expected a small compressed body got %d bytes", enc, v.size, c.Len())
+			}
+
+			if res := DecompressBody(r); res.Code != v.code {
+				t.Errorf("%s %d expected code %d got %d", enc, v.size, v.code, res.Code)
+			}
+		}
+	}
+}
+
+func TestCheckOrigin(t *testing.T) {
+	allowed := []string{"https://www.geonet.org.nz", "http://localhost:8080"}
+
+	in := []struct {
+		method  string
+		origin  string
+		referer string
+		code    int
+	}{
+		{"POST", "https://www.geonet.org.nz", "", http.StatusOK},
+		{"POST", "HTTPS://WWW.GEONET.ORG.NZ", "", http.StatusOK},
+		{"POST", "http://localhost:8080", "", http.StatusOK},
+		{"POST", "https://evil.example.com", "", http.StatusForbidden},
+		{"POST", "https://www.geonet.org.nz.evil.example.com", "", http.StatusForbidden},
+		{"DELETE", "http://localhost", "", http.StatusForbidden},
+		{"POST", "", "https://www.geonet.org.nz/quake/2016p123456?x=1", http.StatusOK},
+		{"POST", "", "https://evil.example.com/www.geonet.org.nz", http.StatusForbidden},
+		{"POST", "https://evil.example.com", "https://www.geonet.org.nz/quake", http.StatusForbidden},
+		{"POST", "null", "https://www.geonet.org.nz/quake", http.StatusOK},
+		{"POST", "", "", http.StatusForbidden},
+		{"POST", "", "/quake", http.StatusForbidden},
+		{"GET", "https://evil.example.com", "", http.StatusOK},
+		{"HEAD", "", "", http.StatusOK},
+		{"OPTIONS", "https://evil.example.com", "", http.StatusOK},
+	}
+
+	for _, v := range in {
+		r := httptest.NewRequest(v.method, "http://test.com/form", nil)
+		if v.origin != "" {
+			r.Header.Set("Origin", v.origin)
+		}
+		if v.referer != "" {
+			r.Header.Set("Referer", v.referer)
+		}
+
+		if res := CheckOrigin(r, allowed); res.Code != v.code {
+			t.Errorf("%s Origin: %s Referer: %s expected code %d got %d", v.method, v.origin, v.referer, v.code, res.Code)
+		}
+	}
+}
+
+func TestFlags(t *testing.T) {
+	in := []struct {
+		header   []string
+		expected map[string]bool
+	}{
+		{nil, map[string]bool{}},
+		{[]string{""}, map[string]bool{}},
+		{[]string{"beta-map"}, map[string]bool{"beta-map": true}},
+		{[]string{"beta-map, New-Search ,,"}, map[string]bool{"beta-map": true, "new-search": true}},
+		{[]string{"beta-map", "dark"}, map[string]bool{"beta-map": true, "dark": true}},
+	}
+
+	for _, v := range in {
+		r := httptest.NewRequest("GET", "http://test.com", nil)
+		for _, h := range v.header {
+			r.Header.Add("X-Feature-Flags", h)
+		}
+
+		if f := Flags(r); !reflect.DeepEqual(f, v.expected) {
+			t.Errorf("%v expected %v got %v", v.header, v.expected, f)
+		}
+	}
+}
+
+func TestCheckFlags(t *testing.T) {
+	allowed := []string{"beta-map", "new-search"}
+
+	in := []struct {
+		header string
+		code   int
+		msg    string
+		flags  map[string]bool
+	}{
+		{"", http.StatusOK, "", map[string]bool{}},
+		{"beta-map", http.StatusOK, "", map[string]bool{"beta-map": true}},
+		{"BETA-MAP,new-search", http.StatusOK, "", map[string]bool{"beta-map": true, "new-search": true}},
+		{"beta-map,admin", http.StatusBadRequest, "unknown feature flag: admin", nil},
+	}
+
+	for _, v := range in {
+		r := httptest.NewRequest("GET", "http://test.com", nil)
+		if v.header != "" {
+			r.Header.Set("X-Feature-Flags", v.header)
+		}
+
+		f, res := CheckFlags(r, allowed)
+
+		if res.Code != v.code {
+			t.Errorf("%s expected code %d got %d", v.header, v.code, res.Code)
+		}
+
+		if res.Msg != v.msg {
+			t.Errorf("%s expected message %s got %s", v.header, v.msg, res.Msg)
+		}
+
+		if !reflect.DeepEqual(f, v.flags) {
+			t.Errorf("%s expected flags %v got %v", v.header, v.flags, f)
+		}
+	}
+}
+
+func TestCheckPathBodyMatch(t *testing.T) {
+	in := []struct {
+		path string
+		body string
+		code int
+		msg  string
+	}{
+		{"WEL", "WEL", http.StatusOK, ""},
+		{"WEL", "TAUP", http.StatusConflict, `identifier in body "TAUP" does not match path "WEL"`},
+		{"WEL", "wel", http.StatusConflict, `identifier in body "wel" does not match path "WEL"`},
+		{"WEL", "", http.StatusConflict, `identifier in body "" does not match path "WEL"`},
+	}
+
+	for _, v := range in {
+		res := CheckPathBodyMatch(v.path, v.body)
+
+		if res.Code != v.code {
+			t.Errorf("%s %s expected code %d got %d", v.path, v.body, v.code, res.Code)
+		}
+
+		if res.Msg != v.msg {
+			t.Errorf("%s %s expected message %s got %s", v.path, v.body, v.msg, res.Msg)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package weft
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+type requestIDKey struct{}
+
+// maxRequestIDLength is the longest X-Request-Id header accepted from a client.
+const maxRequestIDLength = 64
+
+// newRequestID returns a random request ID.
+func newRequestID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// validRequestID returns true if id is safe to echo in headers, logs, and HTML.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_', c == '.':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// withRequestID returns a copy of r with a request ID in its context and the ID.
+// The X-Request-Id header from r is used if it is valid, otherwise a new ID is generated.
+func withRequestID(r *http.Request) (*http.Request, string) {
+	id := r.Header.Get("X-Request-Id")
+	if !validRequestID(id) {
+		id = newRequestID()
+	}
+
+	return r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)), id
+}
+
+/*
+RequestID returns the ID for r or an empty string if there is none.  Handlers made with
+MakeHandlerPage and MakeHandlerAPI are passed requests with an ID taken from the X-Request-Id
+request header or generated.  The ID is returned to the client in the X-Request-Id response
+header and is included in the body of 5xx responses and in logged errors so that a client
+can quote it when reporting a problem.
+*/
+func RequestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
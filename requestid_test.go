@@ -0,0 +1,99 @@
+package weft
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestID(t *testing.T) {
+	in := []struct {
+		header string
+		keep   bool
+	}{
+		{"", false},
+		{"abc-123_x.y", true},
+		{"<script>", false},
+		{"a b", false},
+		{strings.Repeat("a", maxRequestIDLength), true},
+		{strings.Repeat("a", maxRequestIDLength+1), false},
+	}
+
+	for _, v := range in {
+		r := httptest.NewRequest("GET", "http://test.com", nil)
+		if v.header != "" {
+			r.Header.Set("X-Request-Id", v.header)
+		}
+
+		if RequestID(r) != "" {
+			t.Errorf("%s expected no request id before withRequestID", v.header)
+		}
+
+		r, id := withRequestID(r)
+
+		if RequestID(r) != id {
+			t.Errorf("%s expected RequestID %s got %s", v.header, id, RequestID(r))
+		}
+
+		if v.keep && id != v.header {
+			t.Errorf("%s expected request id from header got %s", v.header, id)
+		}
+
+		if !v.keep && (id == v.header || !validRequestID(id)) {
+			t.Errorf("%s expected a new request id got %s", v.header, id)
+		}
+	}
+}
+
+func TestRequestIDErrors(t *testing.T) {
+	fail := func(r *http.Request, h http.Header, b *bytes.Buffer) *Result {
+		return InternalServerError(errors.New("broken"))
+	}
+
+	notFound := func(r *http.Request, h http.Header, b *bytes.Buffer) *Result {
+		return &NotFound
+	}
+
+	in := []struct {
+		id     string
+		method string
+		h      http.HandlerFunc
+		code   int
+		body   string
+	}{
+		{"api-get", "GET", MakeHandlerAPI(fail), http.StatusInternalServerError, "broken (request id: api-get)"},
+		{"api-put", "PUT", MakeHandlerAPI(fail), http.StatusInternalServerError, "broken (request id: api-put)"},
+		{"page", "GET", MakeHandlerPage(fail), http.StatusInternalServerError, "<p>Request ID: page</p>"},
+		{"api-404", "GET", MakeHandlerAPI(notFound), http.StatusNotFound, ""},
+	}
+
+	for _, v := range in {
+		r := httptest.NewRequest(v.method, "http://test.com", nil)
+		r.Header.Set("X-Request-Id", v.id)
+
+		w := httptest.NewRecorder()
+		v.h.ServeHTTP(w, r)
+
+		if w.Code != v.code {
+			t.Errorf("%s expected status %d got %d", v.id, v.code, w.Code)
+		}
+
+		if w.Header().Get("X-Request-Id") != v.id {
+			t.Errorf("%s expected X-Request-Id header %s got %s", v.id, v.id, w.Header().Get("X-Request-Id"))
+		}
+
+		switch v.body {
+		case "":
+			if strings.Contains(w.Body.String(), v.id) {
+				t.Errorf("%s expected no request id in body got %s", v.id, w.Body.String())
+			}
+		default:
+			if !strings.Contains(w.Body.String(), v.body) {
+				t.Errorf("%s expected body to contain %s got %s", v.id, v.body, w.Body.String())
+			}
+		}
+	}
+}
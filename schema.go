@@ -0,0 +1,278 @@
+package weft
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// maxSchemaBody is the largest request body ValidateJSONSchema will read.
+const maxSchemaBody = 1 << 20
+
+type jsonSchema struct {
+	Type                 interface{}            `json:"type"`
+	Properties           map[string]*jsonSchema `json:"properties"`
+	Required             []string               `json:"required"`
+	AdditionalProperties json.RawMessage        `json:"additionalProperties"`
+	Items                *jsonSchema            `json:"items"`
+	Enum                 []interface{}          `json:"enum"`
+	Minimum              *float64               `json:"minimum"`
+	Maximum              *float64               `json:"maximum"`
+	MinLength            *int                   `json:"minLength"`
+	MaxLength            *int                   `json:"maxLength"`
+	MinItems             *int                   `json:"minItems"`
+	MaxItems             *int                   `json:"maxItems"`
+	Pattern              string                 `json:"pattern"`
+}
+
+/*
+ValidateJSONSchema validates the JSON request body of r against the JSON Schema document schema.
+http.StatusUnprocessableEntity is returned with all the validation errors in Msg if the body is
+not valid.  BadRequest is returned if the body is not JSON and http.StatusRequestEntityTooLarge
+if it is larger than 1 MB.  The body is replaced so the handler can decode it.
+
+The keywords type, properties, required, additionalProperties, items, enum, minimum,
+maximum, minLength, maxLength, minItems, maxItems, and pattern are supported.
+Other keywords are ignored.
+*/
+func ValidateJSONSchema(r *http.Request, schema []byte) *Result {
+	var s jsonSchema
+	if err := json.Unmarshal(schema, &s); err != nil {
+		return InternalServerError(fmt.Errorf("invalid JSON schema: %s", err.Error()))
+	}
+
+	b, err := ioutil.ReadAll(io.LimitReader(r.Body, maxSchemaBody+1))
+	if err != nil {
+		return BadRequest("error reading request body")
+	}
+
+	if len(b) > maxSchemaBody {
+		return &Result{Ok: false, Code: http.StatusRequestEntityTooLarge, Msg: "request body too large"}
+	}
+
+	r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(b))
+
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return BadRequest("invalid JSON: " + err.Error())
+	}
+
+	var errs []string
+	if err := s.validate("", v, &errs); err != nil {
+		return InternalServerError(err)
+	}
+
+	if len(errs) > 0 {
+		return &Result{Ok: false, Code: http.StatusUnprocessableEntity, Msg: strings.Join(errs, "; ")}
+	}
+
+	return &StatusOK
+}
+
+// validate appends validation errors for v at path to errs.
+// A non nil error is returned for problems with the schema.
+func (s *jsonSchema) validate(path string, v interface{}, errs *[]string) error {
+	p := path
+	if p == "" {
+		p = "/"
+	}
+
+	fail := func(format string, a ...interface{}) {
+		*errs = append(*errs, p+": "+fmt.Sprintf(format, a...))
+	}
+
+	if s.Type != nil {
+		var types []string
+
+		switch t := s.Type.(type) {
+		case string:
+			types = []string{t}
+		case []interface{}:
+			for _, i := range t {
+				if ts, ok := i.(string); ok {
+					types = append(types, ts)
+				}
+			}
+		}
+
+		var ok bool
+		for _, t := range types {
+			if jsonType(v, t) {
+				ok = true
+			}
+		}
+
+		if !ok {
+			fail("expected %s got %s", strings.Join(types, " or "), jsonTypeName(v))
+			return nil
+		}
+	}
+
+	if len(s.Enum) > 0 {
+		var ok bool
+		for _, e := range s.Enum {
+			if jsonEqual(e, v) {
+				ok = true
+			}
+		}
+		if !ok {
+			fail("value not in enum")
+		}
+	}
+
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for _, k := range s.Required {
+			if _, ok := t[k]; !ok {
+				fail("missing required property %s", k)
+			}
+		}
+
+		var extra *jsonSchema
+		var noExtra bool
+
+		switch a := strings.TrimSpace(string(s.AdditionalProperties)); {
+		case a == "false":
+			noExtra = true
+		case strings.HasPrefix(a, "{"):
+			extra = &jsonSchema{}
+			if err := json.Unmarshal(s.AdditionalProperties, extra); err != nil {
+				return err
+			}
+		}
+
+		keys := make([]string, 0, len(t))
+		for k := range t {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			ps, ok := s.Properties[k]
+			switch {
+			case ok:
+				if err := ps.validate(path+"/"+k, t[k], errs); err != nil {
+					return err
+				}
+			case noExtra:
+				fail("unexpected property %s", k)
+			case extra != nil:
+				if err := extra.validate(path+"/"+k, t[k], errs); err != nil {
+					return err
+				}
+			}
+		}
+	case []interface{}:
+		if s.MinItems != nil && len(t) < *s.MinItems {
+			fail("expected at least %d items", *s.MinItems)
+		}
+		if s.MaxItems != nil && len(t) > *s.MaxItems {
+			fail("expected at most %d items", *s.MaxItems)
+		}
+		if s.Items != nil {
+			for i, e := range t {
+				if err := s.Items.validate(fmt.Sprintf("%s/%d", path, i), e, errs); err != nil {
+					return err
+				}
+			}
+		}
+	case string:
+		n := len([]rune(t))
+		if s.MinLength != nil && n < *s.MinLength {
+			fail("expected length at least %d", *s.MinLength)
+		}
+		if s.MaxLength != nil && n > *s.MaxLength {
+			fail("expected length at most %d", *s.MaxLength)
+		}
+		if s.Pattern != "" {
+			re, err := regexp.Compile(s.Pattern)
+			if err != nil {
+				return err
+			}
+			if !re.MatchString(t) {
+				fail("does not match pattern %s", s.Pattern)
+			}
+		}
+	case json.Number:
+		f, err := t.Float64()
+		if err != nil {
+			fail("invalid number")
+			break
+		}
+		if s.Minimum != nil && f < *s.Minimum {
+			fail("expected minimum %v", *s.Minimum)
+		}
+		if s.Maximum != nil && f > *s.Maximum {
+			fail("expected maximum %v", *s.Maximum)
+		}
+	}
+
+	return nil
+}
+
+// jsonType returns true if v is of the JSON Schema type t.
+func jsonType(v interface{}, t string) bool {
+	switch t {
+	case "integer":
+		n, ok := v.(json.Number)
+		if !ok {
+			return false
+		}
+		_, err := n.Int64()
+		return err == nil
+	case "number":
+		_, ok := v.(json.Number)
+		return ok
+	}
+
+	return jsonTypeName(v) == t
+}
+
+// jsonTypeName returns the JSON Schema type name for v.
+func jsonTypeName(v interface{}) string {
+	switch v.(type) {
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case json.Number:
+		return "number"
+	case bool:
+		return "boolean"
+	}
+
+	return "null"
+}
+
+// jsonEqual returns true if the enum value e equals v.
+func jsonEqual(e, v interface{}) bool {
+	if n, ok := v.(json.Number); ok {
+		f, err := n.Float64()
+		ef, eok := e.(float64)
+		return err == nil && eok && f == ef
+	}
+
+	eb, err := json.Marshal(e)
+	if err != nil {
+		return false
+	}
+
+	vb, err := json.Marshal(v)
+	if err != nil {
+		return false
+	}
+
+	return bytes.Equal(eb, vb)
+}
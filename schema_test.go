@@ -0,0 +1,88 @@
+package weft
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+var quakeSchema = []byte(`{
+	"type": "object",
+	"required": ["publicID", "magnitude"],
+	"additionalProperties": false,
+	"properties": {
+		"publicID": {"type": "string", "pattern": "^[0-9]{4}p[0-9]{6}$"},
+		"magnitude": {"type": "number", "minimum": 0, "maximum": 10},
+		"depth": {"type": "integer"},
+		"type": {"enum": ["earthquake", "explosion"]},
+		"tags": {"type": "array", "items": {"type": "string"}, "maxItems": 3}
+	}
+}`)
+
+func TestValidateJSONSchema(t *testing.T) {
+	in := []struct {
+		body string
+		code int
+		msg  string
+	}{
+		{`{"publicID": "2016p123456", "magnitude": 3.5, "depth": 12, "type": "earthquake", "tags": ["felt"]}`, http.StatusOK, ""},
+		{`{"publicID": "2016p123456"}`, http.StatusUnprocessableEntity, "/: missing required property magnitude"},
+		{`{"publicID": "2016p123456", "magnitude": "big"}`, http.StatusUnprocessableEntity, "/magnitude: expected number got string"},
+		{`{"publicID": 123, "depth": 1.5}`, http.StatusUnprocessableEntity,
+			"/: missing required property magnitude; /depth: expected integer got number; /publicID: expected string got number"},
+		{`{"publicID": "quake", "magnitude": 11, "type": "landslide", "tags": ["a", 2, "c", "d"], "extra": true}`, http.StatusUnprocessableEntity,
+			"/: unexpected property extra; /magnitude: expected maximum 10; /publicID: does not match pattern ^[0-9]{4}p[0-9]{6}$; " +
+				"/tags: expected at most 3 items; /tags/1: expected string got number; /type: value not in enum"},
+		{`[]`, http.StatusUnprocessableEntity, "/: expected object got array"},
+		{`{"publicID": `, http.StatusBadRequest, ""},
+	}
+
+	for _, v := range in {
+		r, err := http.NewRequest("PUT", "http://test.com", strings.NewReader(v.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res := ValidateJSONSchema(r, quakeSchema)
+
+		if res.Code != v.code {
+			t.Errorf("%s expected code %d got %d %s", v.body, v.code, res.Code, res.Msg)
+		}
+
+		if v.msg != "" && res.Msg != v.msg {
+			t.Errorf("%s expected message\n%s got\n%s", v.body, v.msg, res.Msg)
+		}
+
+		if res.Ok {
+			b, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(b) != v.body {
+				t.Error("expected the body to be readable after validation")
+			}
+		}
+	}
+
+	// body size is capped.
+	r, err := http.NewRequest("PUT", "http://test.com", strings.NewReader(`"`+strings.Repeat("a", maxSchemaBody)+`"`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res := ValidateJSONSchema(r, quakeSchema); res.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected code %d got %d", http.StatusRequestEntityTooLarge, res.Code)
+	}
+
+	// invalid schema
+	r, err = http.NewRequest("PUT", "http://test.com", strings.NewReader(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res := ValidateJSONSchema(r, []byte(`{"type": `)); res.Code != http.StatusInternalServerError {
+		t.Errorf("expected code %d got %d", http.StatusInternalServerError, res.Code)
+	}
+}
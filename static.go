@@ -0,0 +1,57 @@
+package weft
+
+import (
+	"bytes"
+	"net/http"
+)
+
+// staticSurrogateControl is the Surrogate-Control for FaviconHandler and RobotsHandler responses.
+const staticSurrogateControl = "max-age=86400"
+
+/*
+FaviconHandler returns a RequestHandler that serves data as /favicon.ico with a long Surrogate-Control.
+If data is empty http.StatusNoContent is returned so that browsers stop asking e.g.,
+
+	http.Handle("/favicon.ico", weft.MakeHandlerAPI(weft.FaviconHandler(nil)))
+*/
+func FaviconHandler(data []byte) RequestHandler {
+	return func(r *http.Request, h http.Header, b *bytes.Buffer) *Result {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			return NotAllowed(h, "GET", "HEAD")
+		}
+
+		h.Set("Surrogate-Control", staticSurrogateControl)
+
+		if len(data) == 0 {
+			return &NoContent
+		}
+
+		h.Set("Content-Type", "image/vnd.microsoft.icon")
+		if b != nil {
+			b.Write(data)
+		}
+
+		return &StatusOK
+	}
+}
+
+/*
+RobotsHandler returns a RequestHandler that serves body as /robots.txt with a long Surrogate-Control e.g.,
+
+	http.Handle("/robots.txt", weft.MakeHandlerAPI(weft.RobotsHandler("User-agent: *\nDisallow:\n")))
+*/
+func RobotsHandler(body string) RequestHandler {
+	return func(r *http.Request, h http.Header, b *bytes.Buffer) *Result {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			return NotAllowed(h, "GET", "HEAD")
+		}
+
+		h.Set("Surrogate-Control", staticSurrogateControl)
+		h.Set("Content-Type", "text/plain; charset=utf-8")
+		if b != nil {
+			b.WriteString(body)
+		}
+
+		return &StatusOK
+	}
+}
@@ -0,0 +1,52 @@
+package weft
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStatic(t *testing.T) {
+	icon := []byte{0, 0, 1, 0, 1, 0, 16, 16}
+	robots := "User-agent: *\nDisallow: /\n"
+
+	in := []struct {
+		id          string
+		method      string
+		h           RequestHandler
+		code        int
+		contentType string
+		surrogate   string
+		body        string
+	}{
+		{"favicon", "GET", FaviconHandler(icon), http.StatusOK, "image/vnd.microsoft.icon", "max-age=86400", string(icon)},
+		{"favicon nil", "GET", FaviconHandler(nil), http.StatusNoContent, "", "max-age=86400", ""},
+		{"favicon head", "HEAD", FaviconHandler(icon), http.StatusOK, "image/vnd.microsoft.icon", "max-age=86400", ""},
+		{"favicon post", "POST", FaviconHandler(icon), http.StatusMethodNotAllowed, "", "max-age=86400", "method not allowed"},
+		{"robots", "GET", RobotsHandler(robots), http.StatusOK, "text/plain; charset=utf-8", "max-age=86400", robots},
+		{"robots post", "POST", RobotsHandler(robots), http.StatusMethodNotAllowed, "", "max-age=86400", "method not allowed"},
+	}
+
+	for _, v := range in {
+		r := httptest.NewRequest(v.method, "http://test.com", nil)
+
+		w := httptest.NewRecorder()
+		MakeHandlerAPI(v.h).ServeHTTP(w, r)
+
+		if w.Code != v.code {
+			t.Errorf("%s expected status %d got %d", v.id, v.code, w.Code)
+		}
+
+		if v.contentType != "" && w.Header().Get("Content-Type") != v.contentType {
+			t.Errorf("%s expected Content-Type %s got %s", v.id, v.contentType, w.Header().Get("Content-Type"))
+		}
+
+		if w.Header().Get("Surrogate-Control") != v.surrogate {
+			t.Errorf("%s expected Surrogate-Control %s got %s", v.id, v.surrogate, w.Header().Get("Surrogate-Control"))
+		}
+
+		if w.Body.String() != v.body {
+			t.Errorf("%s expected body %q got %q", v.id, v.body, w.Body.String())
+		}
+	}
+}
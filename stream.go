@@ -0,0 +1,141 @@
+package weft
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+)
+
+// streamFlushCount is the number of array elements written by StreamArray between flushes to the client.
+const streamFlushCount = 100
+
+// errStream is the error sent to the client in the Weft-Stream-Error trailer.  The cause is only logged.
+var errStream = Result{Ok: false, Code: http.StatusInternalServerError, Msg: "stream failed"}
+
+/*
+StreamArray writes a JSON array to w one element at a time without buffering the whole array
+e.g., for large query results.  next is called for each element until it returns io.EOF.
+Elements are encoded with a json.Encoder.  The response is gzipped if the client accepts it
+and is flushed to the client every 100 elements.
+
+It is for use in an http.Handler as the response is written as it is generated e.g.,
+
+	weft.StreamArray(w, r, func() (interface{}, error) {
+		if !rows.Next() {
+			return nil, io.EOF
+		}
+		var q quake
+		err := rows.Scan(&q.PublicID, &q.Magnitude)
+		return q, err
+	})
+
+A body hash can't be used as an ETag for a streamed response.  Instead set a weak ETag on w
+derived from the version or modification time of the data e.g., W/"42" before calling StreamArray.
+If it matches the If-None-Match header of a GET or HEAD request http.StatusNotModified is written
+and next is not called.
+
+http.StatusOK has been sent before any elements are written so errors can't change the status.
+If next or encoding returns an error the array is not closed, leaving invalid JSON, and the
+Weft-Stream-Error trailer is sent to the client with a generic message and the ID from
+RequestID(r), if any.  The error is logged and returned.
+
+A SHA-256 of the body is computed as it is written and, when the array is complete, is sent in
+the Digest trailer e.g., Digest: sha-256=X48E9qOokqqrvdts8nOJRJN3OWDUoyWxBf7kbu9DBPE=
+The digest is of the bytes sent i.e., after gzip when the response is compressed.  It is not
+sent when there is an error.
+*/
+func StreamArray(w http.ResponseWriter, r *http.Request, next func() (interface{}, error)) error {
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	if w.Header().Get("Surrogate-Control") == "" {
+		w.Header().Set("Surrogate-Control", "max-age=10")
+	}
+	AddVary(w.Header(), "Accept-Encoding")
+
+	if notModified(r, w.Header(), time.Time{}) {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+
+	w.Header().Set("Trailer", "Weft-Stream-Error, Digest")
+
+	h := sha256.New()
+	body := io.MultiWriter(w, h)
+
+	var out io.Writer = body
+	var gz *gzip.Writer
+
+	if acceptsEncoding(r, "gzip") {
+		w.Header().Set("Content-Encoding", "gzip")
+		gz = newGzipWriter(body)
+		out = gz
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	f, _ := w.(http.Flusher)
+	flush := func() {
+		if gz != nil {
+			gz.Flush()
+		}
+		if f != nil {
+			f.Flush()
+		}
+	}
+
+	enc := json.NewEncoder(out)
+	err := streamArray(out, enc, next, flush)
+	if err != nil {
+		logStatus(r, InternalServerError(err))
+		w.Header().Set("Weft-Stream-Error", errorMsg(r, &errStream))
+	}
+
+	if gz != nil {
+		gz.Close()
+	}
+
+	if err == nil {
+		w.Header().Set("Digest", "sha-256="+base64.StdEncoding.EncodeToString(h.Sum(nil)))
+	}
+
+	return err
+}
+
+func streamArray(out io.Writer, enc *json.Encoder, next func() (interface{}, error), flush func()) error {
+	if _, err := io.WriteString(out, "["); err != nil {
+		return err
+	}
+
+	for i := 0; ; i++ {
+		v, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if i > 0 {
+			if _, err := io.WriteString(out, ","); err != nil {
+				return err
+			}
+		}
+
+		if err := enc.Encode(v); err != nil {
+			return err
+		}
+
+		if (i+1)%streamFlushCount == 0 {
+			flush()
+		}
+	}
+
+	_, err := io.WriteString(out, "]")
+
+	return err
+}
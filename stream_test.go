@@ -0,0 +1,207 @@
+package weft
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// sliceNext returns a next func for StreamArray that returns the elements of s then err.
+func sliceNext(s []int, err error) func() (interface{}, error) {
+	var i int
+
+	return func() (interface{}, error) {
+		if i == len(s) {
+			return nil, err
+		}
+		i++
+		return s[i-1], nil
+	}
+}
+
+func TestStreamArray(t *testing.T) {
+	many := make([]int, 250)
+	for i := range many {
+		many[i] = i
+	}
+
+	in := []struct {
+		id     string
+		values []int
+		gzip   bool
+	}{
+		{"empty", []int{}, false},
+		{"single", []int{1}, false},
+		{"multi", []int{1, 2, 3}, false},
+		{"many", many, false},
+		{"empty gzip", []int{}, true},
+		{"many gzip", many, true},
+	}
+
+	for _, v := range in {
+		r := httptest.NewRequest("GET", "http://test.com", nil)
+		if v.gzip {
+			r.Header.Set("Accept-Encoding", "gzip")
+		}
+
+		w := httptest.NewRecorder()
+
+		if err := StreamArray(w, r, sliceNext(v.values, io.EOF)); err != nil {
+			t.Errorf("%s unexpected error %s", v.id, err)
+		}
+
+		if w.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("%s expected Content-Type application/json got %s", v.id, w.Header().Get("Content-Type"))
+		}
+
+		var body io.Reader = w.Body
+
+		if v.gzip {
+			if w.Header().Get("Content-Encoding") != "gzip" {
+				t.Errorf("%s expected Content-Encoding gzip", v.id)
+			}
+
+			gz, err := gzip.NewReader(w.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body = gz
+		}
+
+		var out []int
+		if err := json.NewDecoder(body).Decode(&out); err != nil {
+			t.Errorf("%s invalid JSON: %s", v.id, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(out, v.values) {
+			t.Errorf("%s expected %v got %v", v.id, v.values, out)
+		}
+
+		if e := w.Result().Trailer.Get("Weft-Stream-Error"); e != "" {
+			t.Errorf("%s unexpected Weft-Stream-Error trailer %s", v.id, e)
+		}
+	}
+}
+
+func TestStreamArrayError(t *testing.T) {
+	w := httptest.NewRecorder()
+
+	cause := errors.New("pq: password authentication failed for user quake")
+
+	err := StreamArray(w, httptest.NewRequest("GET", "http://test.com", nil), sliceNext([]int{1, 2}, cause))
+	if err != cause {
+		t.Errorf("expected error %s got %v", cause, err)
+	}
+
+	if e := w.Result().Trailer.Get("Weft-Stream-Error"); e != "stream failed" {
+		t.Errorf("expected Weft-Stream-Error trailer stream failed got %s", e)
+	}
+
+	// the request ID is sent so that the logged error can be found.
+	r, id := withRequestID(httptest.NewRequest("GET", "http://test.com", nil))
+
+	w = httptest.NewRecorder()
+	StreamArray(w, r, sliceNext([]int{1, 2}, cause))
+
+	if e := w.Result().Trailer.Get("Weft-Stream-Error"); e != "stream failed (request id: "+id+")" {
+		t.Errorf("expected Weft-Stream-Error trailer with request id %s got %s", id, e)
+	}
+
+	if d := w.Result().Trailer.Get("Digest"); d != "" {
+		t.Errorf("expected no Digest trailer on error got %s", d)
+	}
+
+	var out []int
+	if json.Unmarshal(w.Body.Bytes(), &out) == nil {
+		t.Errorf("expected invalid JSON for an incomplete array got %s", w.Body.String())
+	}
+}
+
+func TestStreamArrayDigest(t *testing.T) {
+	for _, enc := range []string{"", "gzip"} {
+		r := httptest.NewRequest("GET", "http://test.com", nil)
+		r.Header.Set("Accept-Encoding", enc)
+
+		w := httptest.NewRecorder()
+
+		if err := StreamArray(w, r, sliceNext([]int{1, 2, 3}, io.EOF)); err != nil {
+			t.Errorf("%q unexpected error %s", enc, err)
+		}
+
+		if tr := w.Header().Get("Trailer"); tr != "Weft-Stream-Error, Digest" {
+			t.Errorf("%q expected Trailer header Weft-Stream-Error, Digest got %s", enc, tr)
+		}
+
+		sum := sha256.Sum256(w.Body.Bytes())
+		expected := "sha-256=" + base64.StdEncoding.EncodeToString(sum[:])
+
+		if d := w.Result().Trailer.Get("Digest"); d != expected {
+			t.Errorf("%q expected Digest trailer %s got %s", enc, expected, d)
+		}
+	}
+}
+
+func TestStreamArrayETag(t *testing.T) {
+	in := []struct {
+		ifNoneMatch string
+		code        int
+		calls       int
+	}{
+		{`W/"42"`, http.StatusNotModified, 0},
+		{`"42"`, http.StatusNotModified, 0},
+		{`W/"41"`, http.StatusOK, 4},
+		{"", http.StatusOK, 4},
+	}
+
+	for _, v := range in {
+		r := httptest.NewRequest("GET", "http://test.com", nil)
+		if v.ifNoneMatch != "" {
+			r.Header.Set("If-None-Match", v.ifNoneMatch)
+		}
+
+		var calls int
+		next := sliceNext([]int{1, 2, 3}, io.EOF)
+
+		w := httptest.NewRecorder()
+		w.Header().Set("ETag", `W/"42"`)
+
+		err := StreamArray(w, r, func() (interface{}, error) {
+			calls++
+			return next()
+		})
+		if err != nil {
+			t.Errorf("If-None-Match: %s unexpected error %s", v.ifNoneMatch, err)
+		}
+
+		if w.Code != v.code {
+			t.Errorf("If-None-Match: %s expected status %d got %d", v.ifNoneMatch, v.code, w.Code)
+		}
+
+		if calls != v.calls {
+			t.Errorf("If-None-Match: %s expected %d calls to next got %d", v.ifNoneMatch, v.calls, calls)
+		}
+
+		if w.Header().Get("ETag") != `W/"42"` {
+			t.Errorf("If-None-Match: %s expected ETag W/\"42\" got %s", v.ifNoneMatch, w.Header().Get("ETag"))
+		}
+
+		switch v.code {
+		case http.StatusNotModified:
+			if w.Body.Len() != 0 {
+				t.Errorf("If-None-Match: %s expected empty body for 304", v.ifNoneMatch)
+			}
+		default:
+			if w.Body.String() != "[1\n,2\n,3\n]" {
+				t.Errorf("If-None-Match: %s expected full array got %q", v.ifNoneMatch, w.Body.String())
+			}
+		}
+	}
+}
@@ -5,25 +5,57 @@ package weft
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"github.com/GeoNet/mtr/mtrapp"
 	"net/http"
+	"net/url"
 	"reflect"
 	"runtime"
+	"strconv"
 	"strings"
+	"time"
+	"unicode"
 )
 
 // Return pointers to these as required.
 var (
 	StatusOK         = Result{Ok: true, Code: http.StatusOK, Msg: ""}
+	NoContent        = Result{Ok: true, Code: http.StatusNoContent, Msg: ""}
 	MethodNotAllowed = Result{Ok: false, Code: http.StatusMethodNotAllowed, Msg: "method not allowed"}
 	NotFound         = Result{Ok: false, Code: http.StatusNotFound, Msg: "not found"}
 	NotAcceptable    = Result{Ok: false, Code: http.StatusNotAcceptable, Msg: "specify accept"}
+	Forbidden        = Result{Ok: false, Code: http.StatusForbidden, Msg: "forbidden"}
 )
 
 type Result struct {
-	Ok   bool   // set true to indicate success
-	Code int    // http status code for writing back to the client e.g., http.StatusOK for success.
-	Msg  string // any error message for logging or to send to the client.
+	Ok            bool          // set true to indicate success
+	Code          int           // http status code for writing back to the client e.g., http.StatusOK for success.
+	Msg           string        // any error message for logging or to send to the client.
+	SurrogateKeys []string      // cache tags written to the Surrogate-Key header for targeted purging.
+	Location      string        // written to the Location header when not empty.
+	Age           time.Duration // time since the response was generated e.g., for cached responses.  Written to the Age header when not zero.
+
+	// StaleWhileRevalidate allows caches to serve a stale 2xx response for this long while they revalidate it.
+	// Added to the Surrogate-Control and Cache-Control headers when not zero and they have a max-age.
+	// When Cache-Control is not set it gets the max-age from Surrogate-Control e.g., max-age=10, stale-while-revalidate=60.
+	StaleWhileRevalidate time.Duration
+
+	// Modified is when the resource was last changed.  Written to the Last-Modified header when not zero
+	// and compared to If-Modified-Since in conditional requests.
+	Modified time.Time
+
+	// BlockedBy is the URL of the entity blocking access for http.StatusUnavailableForLegalReasons.
+	// Written to a Link header with rel="blocked-by" when not empty.
+	BlockedBy string
+
+	// RetryAfter is how long clients should wait before retrying e.g., after http.StatusServiceUnavailable.
+	// Written to the Retry-After header in whole seconds, rounded up, when not zero.
+	RetryAfter time.Duration
+
+	// Data is encoded as JSON for the response body by WriteBytes and Write when it is not nil, the
+	// response is 2xx, and the handler has not written to the buffer.  See JSON.
+	Data interface{}
 }
 
 type RequestHandler func(r *http.Request, h http.Header, b *bytes.Buffer) *Result
@@ -36,36 +68,275 @@ func ServiceUnavailableError(err error) *Result {
 	return &Result{Ok: false, Code: http.StatusServiceUnavailable, Msg: err.Error()}
 }
 
+// ServiceUnavailableAfter is ServiceUnavailableError with a Retry-After header asking
+// clients to wait d before retrying.
+func ServiceUnavailableAfter(d time.Duration, err error) *Result {
+	return &Result{Ok: false, Code: http.StatusServiceUnavailable, Msg: err.Error(), RetryAfter: d}
+}
+
+// UnavailableForLegalReasons is for content that is withheld for legal reasons e.g., in some jurisdictions.
+// link should identify the entity that requires the block.  It is written to a Link header with rel="blocked-by".
+func UnavailableForLegalReasons(message, link string) *Result {
+	return &Result{Ok: false, Code: http.StatusUnavailableForLegalReasons, Msg: message, BlockedBy: link}
+}
+
+/*
+JSON is for handlers that respond with data encoded as JSON e.g.,
+
+	return weft.JSON(quake)
+
+WriteBytes and Write encode data into the response body and sets the Content-Type to application/json
+if it is not already set.  If data can't be encoded http.StatusInternalServerError is written.
+*/
+func JSON(data interface{}) *Result {
+	return &Result{Ok: true, Code: http.StatusOK, Data: data}
+}
+
+// NotAllowed sets the Allow header in h to methods e.g., GET, HEAD and returns MethodNotAllowed.
+// Clients use the header to find the methods the resource supports.
+func NotAllowed(h http.Header, methods ...string) *Result {
+	h.Set("Allow", strings.Join(methods, ", "))
+	return &MethodNotAllowed
+}
+
+// Conflict is for requests that conflict with the current state of the resource.
+func Conflict(message string) *Result {
+	return &Result{Ok: false, Code: http.StatusConflict, Msg: message}
+}
+
 func BadRequest(message string) *Result {
 	return &Result{Ok: false, Code: http.StatusBadRequest, Msg: message}
 }
 
+// StatusClientClosedRequest is the Result.Code for requests that the client cancelled before
+// the response was ready.  Write and WriteBytes do not write a response for this code when the
+// request context is done.  Otherwise it is written with Surrogate-Control no-store.
+const StatusClientClosedRequest = 499
+
+/*
+FromContextError returns a Result for err from a cancelled request context e.g.,
+
+	if err := db.QueryRowContext(r.Context(), ...).Scan(&q); err != nil {
+		return weft.FromContextError(err)
+	}
+
+context.DeadlineExceeded returns http.StatusGatewayTimeout.  context.Canceled returns
+StatusClientClosedRequest.  If the client has gone away nothing is written to it.
+Other errors return InternalServerError and a nil err returns StatusOK.
+*/
+func FromContextError(err error) *Result {
+	switch {
+	case err == nil:
+		return &StatusOK
+	case errors.Is(err, context.DeadlineExceeded):
+		return &Result{Ok: false, Code: http.StatusGatewayTimeout, Msg: err.Error()}
+	case errors.Is(err, context.Canceled):
+		return &Result{Ok: false, Code: StatusClientClosedRequest, Msg: err.Error()}
+	}
+
+	return InternalServerError(err)
+}
+
+// Accepted is for requests that have been accepted for asynchronous processing.
+// location should be the URL of a resource for checking the processing status.
+func Accepted(location string) *Result {
+	return &Result{Ok: true, Code: http.StatusAccepted, Location: location}
+}
+
+// PartResult is the result for one part of a batch request.
+type PartResult struct {
+	ID   string `json:"id"`
+	Code int    `json:"code"`
+	Msg  string `json:"message,omitempty"`
+}
+
+/*
+MultiStatus is for batch requests where some parts may succeed and others fail.
+parts are returned in Data and encoded as JSON e.g.,
+
+	{"parts":[{"id":"a","code":200},{"id":"b","code":404,"message":"not found"}]}
+
+http.StatusMultiStatus is 2xx so Write and WriteBytes write Data as for any other success.
+*/
+func MultiStatus(parts []PartResult) *Result {
+	if parts == nil {
+		parts = []PartResult{}
+	}
+
+	return &Result{Ok: true, Code: http.StatusMultiStatus, Data: multiStatus{Parts: parts}}
+}
+
+type multiStatus struct {
+	Parts []PartResult `json:"parts"`
+}
+
+/*
+OptionsHandler returns a RequestHandler that responds to OPTIONS requests with
+http.StatusNoContent and the Allow header set to methods e.g.,
+
+	OptionsHandler("GET", "PUT", "OPTIONS")
+
+It can be registered for a route or called from the method switch in a handler.
+*/
+func OptionsHandler(methods ...string) RequestHandler {
+	allow := strings.Join(methods, ", ")
+
+	return func(r *http.Request, h http.Header, b *bytes.Buffer) *Result {
+		h.Set("Allow", allow)
+		return &NoContent
+	}
+}
+
+// RejectBlank makes CheckQuery treat required query parameters that are empty after
+// trimming white space e.g., ?publicID=%20 as missing.  The default, false, only
+// rejects empty values.  Set during init.
+var RejectBlank = false
+
+// IgnoredQueryParams are query parameters that CheckQuery allows in any request without them
+// being listed as required or optional e.g., utm_source added by a CDN for analytics.
+// They are ignored unless listed as required or optional.  Empty by default.  Set during init.
+var IgnoredQueryParams []string
+
+/*
+CheckQueryCount returns BadRequest if r has more than max distinct query parameters.
+It is a cheap guard against abusive requests to call before CheckQuery.
+*/
+func CheckQueryCount(r *http.Request, max int) *Result {
+	if len(r.URL.Query()) > max {
+		return BadRequest("too many query parameters: maximum is " + strconv.Itoa(max))
+	}
+
+	return &StatusOK
+}
+
 /*
 CheckQuery inspects r and makes sure all required query parameters
 are present and that no more than the required and optional parameters
-are present.
+are present.  See also RejectBlank and IgnoredQueryParams.
 */
 func CheckQuery(r *http.Request, required, optional []string) *Result {
+	_, res := CheckQueryValues(r, required, optional)
+	return res
+}
+
+/*
+CheckQueryValues validates the query parameters in r the same as CheckQuery and also
+returns the parsed query so that handlers don't need to parse it again e.g.,
+
+	v, res := weft.CheckQueryValues(r, []string{"publicID"}, []string{})
+	if !res.Ok {
+		return res
+	}
+
+	q, err := getQuake(v.Get("publicID"))
+
+v is nil if res is not ok.
+*/
+func CheckQueryValues(r *http.Request, required, optional []string) (v url.Values, res *Result) {
+	v, _, res = checkQuery(r, required, optional, nil)
+	return v, res
+}
+
+/*
+CheckQueryPresent validates the query parameters in r the same as CheckQuery and
+also returns the required and optional parameters that are present in r e.g., for
+logging which optional parameters clients use.  The present parameters are in the
+order they are listed in required then optional.  They are nil if res is not ok.
+*/
+func CheckQueryPresent(r *http.Request, required, optional []string) (present []string, res *Result) {
+	_, present, res = checkQuery(r, required, optional, nil)
+	return present, res
+}
+
+/*
+CheckQuerySafe validates the query parameters in r the same as CheckQuery and also returns
+BadRequest if any value contains a control character e.g., a NUL byte or a line break,
+to protect downstream systems.
+*/
+func CheckQuerySafe(r *http.Request, required, optional []string) *Result {
+	q, _, res := checkQuery(r, required, optional, nil)
+	if !res.Ok {
+		return res
+	}
+
+	for k, v := range q {
+		for _, s := range v {
+			if strings.IndexFunc(s, unicode.IsControl) >= 0 {
+				return BadRequest("invalid character in query parameter: " + k)
+			}
+		}
+	}
+
+	return &StatusOK
+}
+
+/*
+CheckQueryFlags validates the query parameters in r the same as CheckQuery with flags
+that are satisfied by being present with or without a value e.g., ?debug or ?debug=true.
+flags may also be listed in required.  Flags that are not required are optional.
+BadRequest is returned for a flag with a value that is not a boolean.  Use HasFlag
+to read flags.
+*/
+func CheckQueryFlags(r *http.Request, required, optional, flags []string) *Result {
+	v, _, res := checkQuery(r, required, append(append([]string{}, optional...), flags...), flags)
+	if !res.Ok {
+		return res
+	}
+
+	for _, k := range flags {
+		if s := v.Get(k); s != "" {
+			if _, err := strconv.ParseBool(s); err != nil {
+				return BadRequest("invalid value for flag parameter: " + k)
+			}
+		}
+	}
+
+	return &StatusOK
+}
+
+// checkQuery is the implementation of the CheckQuery functions.  It returns the query from r
+// and the required and optional parameters that are present.  Required parameters that are in
+// flags only need to be present.
+func checkQuery(r *http.Request, required, optional, flags []string) (url.Values, []string, *Result) {
 	if strings.Contains(r.URL.Path, ";") {
-		return BadRequest("cache buster")
+		return nil, nil, BadRequest("cache buster")
 	}
 
-	v := r.URL.Query()
+	q := r.URL.Query()
+
+	// v is a copy of q for removing the parameters that have been checked.
+	v := make(url.Values, len(q))
+	for k, s := range q {
+		v[k] = s
+	}
+
+	for _, k := range IgnoredQueryParams {
+		if !contains(required, k) && !contains(optional, k) {
+			v.Del(k)
+		}
+	}
 
 	if len(required) == 0 && len(optional) == 0 {
 		if len(v) == 0 {
-			return &StatusOK
+			return q, nil, &StatusOK
 		} else {
-			return BadRequest("found unexpected query parameters")
+			return nil, nil, BadRequest("found unexpected query parameters")
 		}
 	}
 
-	var missing []string
+	var missing, present []string
 
 	for _, k := range required {
-		if v.Get(k) == "" {
+		if _, ok := v[k]; ok && contains(flags, k) {
+			present = append(present, k)
+			v.Del(k)
+			continue
+		}
+
+		if s := v.Get(k); s == "" || (RejectBlank && strings.TrimSpace(s) == "") {
 			missing = append(missing, k)
 		} else {
+			present = append(present, k)
 			v.Del(k)
 		}
 	}
@@ -73,20 +344,39 @@ func CheckQuery(r *http.Request, required, optional []string) *Result {
 	switch len(missing) {
 	case 0:
 	case 1:
-		return BadRequest("missing required query parameter: " + missing[0])
+		return nil, nil, BadRequest("missing required query parameter: " + missing[0])
 	default:
-		return BadRequest("missing required query parameters: " + strings.Join(missing, ", "))
+		return nil, nil, BadRequest("missing required query parameters: " + strings.Join(missing, ", "))
 	}
 
 	for _, k := range optional {
+		if _, ok := v[k]; ok {
+			present = append(present, k)
+		}
 		v.Del(k)
 	}
 
 	if len(v) > 0 {
-		return BadRequest("found additional query parameters")
+		return nil, nil, BadRequest("found additional query parameters")
 	}
 
-	return &StatusOK
+	return q, present, &StatusOK
+}
+
+// contains returns true if s is in list.
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// success returns true if code is a 2xx http status code.
+func success(code int) bool {
+	return code >= http.StatusOK && code < http.StatusMultipleChoices
 }
 
 // name finds the name of the function f
@@ -1,8 +1,15 @@
 package weft
 
 import (
-	"testing"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
 )
 
 func TestCheckQuery(t *testing.T) {
@@ -63,3 +70,516 @@ func TestCheckQuery(t *testing.T) {
 		t.Error("expected false, cache busta")
 	}
 }
+
+func TestCheckQueryRejectBlank(t *testing.T) {
+	defer func() { RejectBlank = false }()
+
+	in := []struct {
+		query       string
+		rejectBlank bool
+		ok          bool
+	}{
+		{"publicID=%20", false, true},
+		{"publicID=%20%09", false, true},
+		{"publicID=%20", true, false},
+		{"publicID=%20%09", true, false},
+		{"publicID=%202016p123456", true, true},
+		{"publicID=", false, false},
+		{"publicID=", true, false},
+	}
+
+	for _, v := range in {
+		r, err := http.NewRequest("GET", "http://test.com?"+v.query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		RejectBlank = v.rejectBlank
+
+		res := CheckQuery(r, []string{"publicID"}, []string{})
+
+		if res.Ok != v.ok {
+			t.Errorf("%s RejectBlank %t expected ok %t got %t", v.query, v.rejectBlank, v.ok, res.Ok)
+		}
+
+		if !v.ok && res.Msg != "missing required query parameter: publicID" {
+			t.Errorf("%s RejectBlank %t wrong message %s", v.query, v.rejectBlank, res.Msg)
+		}
+	}
+}
+
+func TestIgnoredQueryParams(t *testing.T) {
+	defer func() { IgnoredQueryParams = nil }()
+
+	in := []struct {
+		query    string
+		optional []string
+		ignored  []string
+		ok       bool
+	}{
+		{"publicID=2016p123456&utm_source=cdn", nil, nil, false},
+		{"publicID=2016p123456&utm_source=cdn", nil, []string{"utm_source", "utm_medium"}, true},
+		{"publicID=2016p123456&utm_source=cdn&utm_medium=web", nil, []string{"utm_source", "utm_medium"}, true},
+		{"publicID=2016p123456&utm_source=cdn&extra=1", nil, []string{"utm_source"}, false},
+		{"publicID=2016p123456&utm_source=cdn", []string{"utm_source"}, []string{"utm_source"}, true},
+	}
+
+	for _, v := range in {
+		r, err := http.NewRequest("GET", "http://test.com?"+v.query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		IgnoredQueryParams = v.ignored
+
+		if res := CheckQuery(r, []string{"publicID"}, v.optional); res.Ok != v.ok {
+			t.Errorf("%s ignored %v expected ok %t got %t", v.query, v.ignored, v.ok, res.Ok)
+		}
+	}
+
+	// ignored parameters are allowed for handlers with no query parameters.
+	IgnoredQueryParams = []string{"utm_source"}
+
+	r, err := http.NewRequest("GET", "http://test.com?utm_source=cdn", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !CheckQuery(r, []string{}, []string{}).Ok {
+		t.Error("expected ignored parameter to be allowed")
+	}
+
+	// but can still be required.
+	if present, res := CheckQueryPresent(r, []string{"utm_source"}, []string{}); !res.Ok || len(present) != 1 {
+		t.Errorf("expected required ignored parameter to be present got %v %s", present, res.Msg)
+	}
+}
+
+func TestCheckQueryFlags(t *testing.T) {
+	in := []struct {
+		query    string
+		required []string
+		ok       bool
+		debug    bool
+	}{
+		{"publicID=2016p123456&debug", nil, true, true},
+		{"publicID=2016p123456&debug=", nil, true, true},
+		{"publicID=2016p123456&debug=true", nil, true, true},
+		{"publicID=2016p123456&debug=false", nil, true, false},
+		{"publicID=2016p123456&debug=maybe", nil, false, false},
+		{"publicID=2016p123456", nil, true, false},
+		{"publicID=2016p123456&debug", []string{"debug"}, true, true},
+		{"publicID=2016p123456", []string{"debug"}, false, false},
+		{"debug", nil, false, true},
+		{"publicID=&debug", nil, false, true},
+		{"publicID=2016p123456&debug&extra", nil, false, true},
+	}
+
+	for _, v := range in {
+		r, err := http.NewRequest("GET", "http://test.com?"+v.query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res := CheckQueryFlags(r, append([]string{"publicID"}, v.required...), []string{"limit"}, []string{"debug"})
+
+		if res.Ok != v.ok {
+			t.Errorf("%s required %v expected ok %t got %t %s", v.query, v.required, v.ok, res.Ok, res.Msg)
+		}
+
+		if HasFlag(r, "debug") != v.debug {
+			t.Errorf("%s expected HasFlag %t", v.query, v.debug)
+		}
+	}
+}
+
+func TestCheckQueryCount(t *testing.T) {
+	in := []struct {
+		query string
+		ok    bool
+	}{
+		{"", true},
+		{"a=1&b=2", true},
+		{"a=1&b=2&c=3", true},
+		{"a=1&a=2&b=2&c=3", true},
+		{"a=1&b=2&c=3&d=4", false},
+	}
+
+	for _, v := range in {
+		r, err := http.NewRequest("GET", "http://test.com?"+v.query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res := CheckQueryCount(r, 3)
+
+		if res.Ok != v.ok {
+			t.Errorf("%s expected ok %t got %t", v.query, v.ok, res.Ok)
+		}
+
+		if !v.ok && (res.Code != http.StatusBadRequest || res.Msg != "too many query parameters: maximum is 3") {
+			t.Errorf("%s unexpected result %d %s", v.query, res.Code, res.Msg)
+		}
+	}
+}
+
+func TestCheckQueryValues(t *testing.T) {
+	in := []struct {
+		query    string
+		publicID string
+		limit    string
+		ok       bool
+	}{
+		{"publicID=2016p123456", "2016p123456", "", true},
+		{"publicID=2016p123456&limit=10", "2016p123456", "10", true},
+		{"limit=10", "", "", false},
+		{"publicID=2016p123456&extra=1", "", "", false},
+	}
+
+	for _, v := range in {
+		r, err := http.NewRequest("GET", "http://test.com?"+v.query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		q, res := CheckQueryValues(r, []string{"publicID"}, []string{"limit"})
+
+		if res.Ok != v.ok {
+			t.Errorf("%s expected ok %t got %t", v.query, v.ok, res.Ok)
+		}
+
+		if res.Ok != CheckQuery(r, []string{"publicID"}, []string{"limit"}).Ok {
+			t.Errorf("%s expected same result as CheckQuery", v.query)
+		}
+
+		if !v.ok {
+			if q != nil {
+				t.Errorf("%s expected nil values got %v", v.query, q)
+			}
+			continue
+		}
+
+		if q.Get("publicID") != v.publicID || q.Get("limit") != v.limit {
+			t.Errorf("%s expected publicID %s limit %s got %v", v.query, v.publicID, v.limit, q)
+		}
+	}
+}
+
+func TestCheckQueryPresent(t *testing.T) {
+	in := []struct {
+		query   string
+		present string
+		ok      bool
+	}{
+		{"publicID=2016p123456", "publicID", true},
+		{"publicID=2016p123456&limit=10", "publicID limit", true},
+		{"format=csv&publicID=2016p123456&limit=10", "publicID limit format", true},
+		{"publicID=2016p123456&format=", "publicID format", true},
+		{"limit=10", "", false},
+		{"publicID=2016p123456&extra=1", "", false},
+	}
+
+	for _, v := range in {
+		r, err := http.NewRequest("GET", "http://test.com?"+v.query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		present, res := CheckQueryPresent(r, []string{"publicID"}, []string{"limit", "format"})
+
+		if res.Ok != v.ok {
+			t.Errorf("%s expected ok %t got %t", v.query, v.ok, res.Ok)
+		}
+
+		if res.Ok != CheckQuery(r, []string{"publicID"}, []string{"limit", "format"}).Ok {
+			t.Errorf("%s expected same result as CheckQuery", v.query)
+		}
+
+		if strings.Join(present, " ") != v.present {
+			t.Errorf("%s expected present %s got %s", v.query, v.present, strings.Join(present, " "))
+		}
+	}
+}
+
+func TestCheckQuerySafe(t *testing.T) {
+	in := []struct {
+		query string
+		msg   string
+	}{
+		{"publicID=2016p123456", ""},
+		{"publicID=2016p123456&region=hawke%27s%20bay", ""},
+		{"publicID=2016p123456&region=M%C4%81ori", ""},
+		{"publicID=2016p%00123456", "invalid character in query parameter: publicID"},
+		{"publicID=2016p123456&region=a%0Db", "invalid character in query parameter: region"},
+		{"publicID=2016p123456&region=a%09b", "invalid character in query parameter: region"},
+		{"publicID=2016p123456&region=a%7Fb", "invalid character in query parameter: region"},
+		{"region=wellington", "missing required query parameter: publicID"},
+		{"publicID=2016p123456&extra=%00", "found additional query parameters"},
+	}
+
+	for _, v := range in {
+		r, err := http.NewRequest("GET", "http://test.com?"+v.query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res := CheckQuerySafe(r, []string{"publicID"}, []string{"region"})
+
+		switch v.msg {
+		case "":
+			if !res.Ok {
+				t.Errorf("%s expected ok got %s", v.query, res.Msg)
+			}
+		default:
+			if res.Code != http.StatusBadRequest {
+				t.Errorf("%s expected code %d got %d", v.query, http.StatusBadRequest, res.Code)
+			}
+			if res.Msg != v.msg {
+				t.Errorf("%s expected message %s got %s", v.query, v.msg, res.Msg)
+			}
+		}
+	}
+}
+
+func TestOptionsHandler(t *testing.T) {
+	r, err := http.NewRequest("OPTIONS", "http://test.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	MakeHandlerAPI(OptionsHandler("GET", "PUT", "OPTIONS")).ServeHTTP(w, r)
+
+	if w.Code != http.StatusNoContent {
+		t.Errorf("expected status %d got %d", http.StatusNoContent, w.Code)
+	}
+
+	if w.Header().Get("Allow") != "GET, PUT, OPTIONS" {
+		t.Errorf("expected Allow GET, PUT, OPTIONS got %s", w.Header().Get("Allow"))
+	}
+
+	if w.Body.Len() != 0 {
+		t.Errorf("expected empty body got %s", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	MakeHandlerAPI(OptionsHandler("GET")).ServeHTTP(w, r)
+
+	if w.Code != http.StatusNoContent {
+		t.Errorf("expected status %d got %d", http.StatusNoContent, w.Code)
+	}
+
+	if w.Header().Get("Allow") != "GET" {
+		t.Errorf("expected Allow GET got %s", w.Header().Get("Allow"))
+	}
+}
+
+func TestMultiStatus(t *testing.T) {
+	parts := []PartResult{
+		{ID: "a", Code: http.StatusOK},
+		{ID: "b", Code: http.StatusNotFound, Msg: "not found"},
+	}
+
+	res := MultiStatus(parts)
+
+	if !res.Ok || res.Code != http.StatusMultiStatus {
+		t.Errorf("expected ok with code %d got %t %d", http.StatusMultiStatus, res.Ok, res.Code)
+	}
+
+	e := `{"parts":[{"id":"a","code":200},{"id":"b","code":404,"message":"not found"}]}`
+
+	// batch requests are usually POST which is written with Write.
+	r, err := http.NewRequest("POST", "http://test.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := func(r *http.Request, h http.Header, b *bytes.Buffer) *Result {
+		return MultiStatus(parts)
+	}
+
+	w := httptest.NewRecorder()
+	MakeHandlerAPI(h).ServeHTTP(w, r)
+
+	if w.Code != http.StatusMultiStatus {
+		t.Errorf("expected status %d got %d", http.StatusMultiStatus, w.Code)
+	}
+
+	if w.Body.String() != e {
+		t.Errorf("expected body %s got %s", e, w.Body.String())
+	}
+
+	if w.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("expected Content-Type application/json got %s", w.Header().Get("Content-Type"))
+	}
+
+	// no error page for 207.
+	r, err = http.NewRequest("GET", "http://test.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w = httptest.NewRecorder()
+	MakeHandlerPage(h).ServeHTTP(w, r)
+
+	if w.Code != http.StatusMultiStatus {
+		t.Errorf("expected status %d got %d", http.StatusMultiStatus, w.Code)
+	}
+
+	if w.Body.String() != e {
+		t.Errorf("expected body %s got %s", e, w.Body.String())
+	}
+
+	if w.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("expected Content-Type application/json got %s", w.Header().Get("Content-Type"))
+	}
+
+	// empty parts is an empty list.
+	if b, _ := json.Marshal(MultiStatus(nil).Data); string(b) != `{"parts":[]}` {
+		t.Errorf("expected empty parts got %s", b)
+	}
+
+	if res.Msg != "" {
+		t.Errorf("expected no message got %s", res.Msg)
+	}
+}
+
+func TestFromContextError(t *testing.T) {
+	in := []struct {
+		err  error
+		code int
+	}{
+		{nil, http.StatusOK},
+		{context.DeadlineExceeded, http.StatusGatewayTimeout},
+		{fmt.Errorf("query: %w", context.DeadlineExceeded), http.StatusGatewayTimeout},
+		{context.Canceled, StatusClientClosedRequest},
+		{fmt.Errorf("query: %w", context.Canceled), StatusClientClosedRequest},
+		{errors.New("broken"), http.StatusInternalServerError},
+	}
+
+	for _, v := range in {
+		res := FromContextError(v.err)
+
+		if res.Code != v.code {
+			t.Errorf("%v expected code %d got %d", v.err, v.code, res.Code)
+		}
+
+		if res.Ok != (v.err == nil) {
+			t.Errorf("%v expected ok %t got %t", v.err, v.err == nil, res.Ok)
+		}
+	}
+
+	// nothing is written for a cancelled request.
+	h := func(r *http.Request, h http.Header, b *bytes.Buffer) *Result {
+		if b != nil {
+			b.WriteString("bogan impsum bogan impsum")
+		}
+		return FromContextError(context.Canceled)
+	}
+
+	for _, m := range []string{"GET", "PUT"} {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		w := httptest.NewRecorder()
+		MakeHandlerAPI(h).ServeHTTP(w, httptest.NewRequest(m, "http://test.com", nil).WithContext(ctx))
+
+		if w.Code != http.StatusOK || w.Flushed || w.Body.Len() != 0 || len(w.Header()["Surrogate-Control"]) != 0 {
+			t.Errorf("%s expected nothing written got %d %s", m, w.Code, w.Body.String())
+		}
+	}
+
+	// the client is still there e.g., for a context cancelled inside the handler.
+	for _, m := range []string{"GET", "PUT"} {
+		w := httptest.NewRecorder()
+		MakeHandlerAPI(h).ServeHTTP(w, httptest.NewRequest(m, "http://test.com", nil))
+
+		if w.Code != StatusClientClosedRequest {
+			t.Errorf("%s expected status %d got %d", m, StatusClientClosedRequest, w.Code)
+		}
+
+		if s := w.Header().Get("Surrogate-Control"); s != "no-store" {
+			t.Errorf("%s expected Surrogate-Control no-store got %s", m, s)
+		}
+
+		if w.Body.String() != "context canceled" {
+			t.Errorf("%s expected body context canceled got %s", m, w.Body.String())
+		}
+	}
+}
+
+func TestUnavailableForLegalReasons(t *testing.T) {
+	res := UnavailableForLegalReasons("withheld", "https://example.com/authority")
+
+	if res.Ok || res.Code != http.StatusUnavailableForLegalReasons || res.Msg != "withheld" || res.BlockedBy != "https://example.com/authority" {
+		t.Errorf("unexpected result %+v", res)
+	}
+
+	h := func(r *http.Request, h http.Header, b *bytes.Buffer) *Result {
+		return res
+	}
+
+	for _, m := range []string{"GET", "PUT"} {
+		w := httptest.NewRecorder()
+		MakeHandlerAPI(h).ServeHTTP(w, httptest.NewRequest(m, "http://test.com", nil))
+
+		if w.Code != http.StatusUnavailableForLegalReasons {
+			t.Errorf("%s expected status %d got %d", m, http.StatusUnavailableForLegalReasons, w.Code)
+		}
+
+		if l := w.Header().Get("Link"); l != `<https://example.com/authority>; rel="blocked-by"` {
+			t.Errorf("%s wrong Link header %s", m, l)
+		}
+
+		if s := w.Header().Get("Surrogate-Control"); s != "max-age=86400" {
+			t.Errorf("%s expected Surrogate-Control max-age=86400 got %s", m, s)
+		}
+
+		if w.Body.String() != "withheld" {
+			t.Errorf("%s expected body withheld got %s", m, w.Body.String())
+		}
+	}
+}
+
+func TestNotAllowed(t *testing.T) {
+	h := func(r *http.Request, h http.Header, b *bytes.Buffer) *Result {
+		switch r.Method {
+		case "GET", "PUT":
+			return &StatusOK
+		default:
+			return NotAllowed(h, "GET", "PUT")
+		}
+	}
+
+	in := []struct {
+		method string
+		code   int
+		allow  string
+	}{
+		{"GET", http.StatusOK, ""},
+		{"PUT", http.StatusOK, ""},
+		{"DELETE", http.StatusMethodNotAllowed, "GET, PUT"},
+		{"POST", http.StatusMethodNotAllowed, "GET, PUT"},
+	}
+
+	for _, v := range in {
+		w := httptest.NewRecorder()
+		MakeHandlerAPI(h).ServeHTTP(w, httptest.NewRequest(v.method, "http://test.com", nil))
+
+		if w.Code != v.code {
+			t.Errorf("%s expected status %d got %d", v.method, v.code, w.Code)
+		}
+
+		if w.Header().Get("Allow") != v.allow {
+			t.Errorf("%s expected Allow %q got %q", v.method, v.allow, w.Header().Get("Allow"))
+		}
+	}
+
+	// static handlers
+	w := httptest.NewRecorder()
+	MakeHandlerAPI(RobotsHandler("")).ServeHTTP(w, httptest.NewRequest("POST", "http://test.com/robots.txt", nil))
+
+	if w.Header().Get("Allow") != "GET, HEAD" {
+		t.Errorf("expected Allow GET, HEAD got %q", w.Header().Get("Allow"))
+	}
+}